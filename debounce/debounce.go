@@ -0,0 +1,285 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+// Package debounce coalesces the events of a fsnotify.Watcher, so that a
+// burst of them for a path, such as an editor saving a file, is reported
+// once the path has been quiet for a while.
+package debounce
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shogo82148/fsnotify"
+)
+
+// Debouncer reports the events of a Watcher once per path, after nothing has
+// happened to the path for the quiet period, or the maximum latency has
+// passed since its first event. The event carries the union of the
+// operations that happened, except that:
+//
+//   - a path created and removed again, or renamed away, is not reported
+//     at all;
+//   - a path removed or renamed away and then created again, as editors do
+//     when saving, is reported with Write;
+//   - a file created and then renamed over a path, as editors also do when
+//     saving, is reported with Write for that path and no OldName, or with
+//     Create if the path was created since the first event as well.
+//
+// The other fields are those of the last event for the path. Errors are
+// passed on as they come.
+type Debouncer struct {
+	Events chan fsnotify.Event
+	Errors chan error
+
+	w          *fsnotify.Watcher
+	quiet      time.Duration
+	maxLatency time.Duration // Zero for no limit
+	clock      Clock
+	done       chan struct{} // Closed by Close
+
+	mu      sync.Mutex
+	pending map[string]*entry // Events waiting for their path to be quiet (key: path)
+	ready   []fsnotify.Event  // Events to send on Events
+	wake    chan struct{}     // Signalled when an event is ready
+}
+
+// entry is the coalesced events for a path.
+type entry struct {
+	event   fsnotify.Event // Last event, with the coalesced operations
+	created bool           // The path didn't exist before the first event
+	gone    bool           // The path doesn't exist after the last event
+	first   time.Time      // When the first event was received
+	timer   Timer          // Fires when the event is due
+	gen     int            // Incremented whenever the timer is replaced
+}
+
+// Clock tells the time and runs timers for a Debouncer, so that tests can
+// replace them.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock, like a *time.Timer.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// An Option configures a Debouncer.
+type Option func(*Debouncer)
+
+// WithMaxLatency reports a path at most d after its first event, even if it
+// never goes quiet, such as a log file being written to.
+func WithMaxLatency(d time.Duration) Option {
+	return func(deb *Debouncer) {
+		deb.maxLatency = d
+	}
+}
+
+// WithClock makes the Debouncer use c rather than the system clock.
+func WithClock(c Clock) Option {
+	return func(deb *Debouncer) {
+		deb.clock = c
+	}
+}
+
+// New starts coalescing the events of w over the quiet period. The
+// Debouncer receives from the channels of w from now on, including Batches.
+func New(w *fsnotify.Watcher, quiet time.Duration, opts ...Option) *Debouncer {
+	deb := &Debouncer{
+		Events:  make(chan fsnotify.Event),
+		Errors:  make(chan error),
+		w:       w,
+		quiet:   quiet,
+		clock:   realClock{},
+		done:    make(chan struct{}),
+		pending: make(map[string]*entry),
+		wake:    make(chan struct{}, 1),
+	}
+	for _, o := range opts {
+		o(deb)
+	}
+	go deb.run()
+	return deb
+}
+
+// Close closes the Watcher, which stops the Debouncer. Events still waiting
+// for their path to be quiet are dropped.
+func (deb *Debouncer) Close() error {
+	deb.mu.Lock()
+	select {
+	case <-deb.done:
+		deb.mu.Unlock()
+		return nil
+	default:
+	}
+	close(deb.done)
+	deb.mu.Unlock()
+	return deb.w.Close()
+}
+
+func (deb *Debouncer) run() {
+	defer close(deb.Errors)
+	defer close(deb.Events)
+	defer deb.stop()
+
+	events, batches, errors := deb.w.Events, deb.w.Batches, deb.w.Errors
+	for {
+		var (
+			out  chan fsnotify.Event // Set when an event is ready
+			next fsnotify.Event
+		)
+		deb.mu.Lock()
+		if len(deb.ready) > 0 {
+			out, next = deb.Events, deb.ready[0]
+		}
+		deb.mu.Unlock()
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			deb.add(event)
+		case batch, ok := <-batches:
+			if !ok {
+				return
+			}
+			for _, event := range batch {
+				deb.add(event)
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			select {
+			case deb.Errors <- err:
+			case <-deb.done:
+				return
+			}
+		case out <- next:
+			deb.mu.Lock()
+			deb.ready[0] = fsnotify.Event{}
+			deb.ready = deb.ready[1:]
+			deb.mu.Unlock()
+		case <-deb.wake:
+		case <-deb.done:
+			return
+		}
+	}
+}
+
+// stop stops the timers of the events still waiting.
+func (deb *Debouncer) stop() {
+	deb.mu.Lock()
+	defer deb.mu.Unlock()
+	for path, e := range deb.pending {
+		e.timer.Stop()
+		delete(deb.pending, path)
+	}
+}
+
+// add coalesces event with those waiting for its path.
+func (deb *Debouncer) add(event fsnotify.Event) {
+	gone := event.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+	appeared := event.Op&fsnotify.Create == fsnotify.Create
+
+	deb.mu.Lock()
+	defer deb.mu.Unlock()
+	var saved bool
+	if old := deb.pending[event.OldName]; event.OldName != "" && old != nil && old.created {
+		// Such as the temporary file of a save: nothing to report for it,
+		// and the path it was renamed to was written rather than renamed.
+		old.timer.Stop()
+		delete(deb.pending, event.OldName)
+		event.OldName = ""
+		saved = true
+	}
+	now := deb.clock.Now()
+	e := deb.pending[event.Name]
+	switch {
+	case e == nil:
+		e = &entry{event: event, created: appeared && !gone && !saved, gone: gone, first: now}
+		if saved {
+			e.event.Op = event.Op&^fsnotify.Create | fsnotify.Write
+		}
+		deb.pending[event.Name] = e
+	case gone && e.created:
+		// Created and removed or renamed away again: nothing to report,
+		// but kept until it expires for the rename to find it.
+		e.event = event
+		e.gone = true
+	case appeared && e.gone && e.created:
+		// Created again after that: start afresh.
+		e.event = event
+		e.gone = false
+		e.first = now
+	case appeared && e.gone:
+		// Replaced, such as by an editor saving.
+		ops := e.event.Op&^(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) | event.Op&^fsnotify.Create | fsnotify.Write
+		e.event = event
+		e.event.Op = ops
+		e.event.OldName = ""
+		e.gone = false
+	default:
+		ops := e.event.Op | event.Op
+		if saved && !e.created {
+			ops = ops&^fsnotify.Create | fsnotify.Write
+		}
+		oldName := e.event.OldName
+		e.event = event
+		e.event.Op = ops
+		if event.OldName == "" {
+			e.event.OldName = oldName
+		}
+		e.gone = gone || (e.gone && !appeared)
+	}
+
+	// Wait for the path to be quiet again, but no longer than allowed.
+	wait := deb.quiet
+	if deb.maxLatency > 0 {
+		if left := e.first.Add(deb.maxLatency).Sub(now); left < wait {
+			wait = left
+		}
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.gen++
+	gen := e.gen
+	e.timer = deb.clock.AfterFunc(wait, func() { deb.expire(event.Name, e, gen) })
+}
+
+// expire makes the event of e ready to send, unless its timer was replaced
+// by the generation gen or its path came and went.
+func (deb *Debouncer) expire(path string, e *entry, gen int) {
+	deb.mu.Lock()
+	if deb.pending[path] != e || e.gen != gen {
+		deb.mu.Unlock()
+		return
+	}
+	delete(deb.pending, path)
+	if e.created && e.gone {
+		deb.mu.Unlock()
+		return
+	}
+	deb.ready = append(deb.ready, e.event)
+	deb.mu.Unlock()
+
+	select {
+	case deb.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package debounce
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shogo82148/fsnotify"
+)
+
+// fakeClock is a Clock whose time only moves when advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+	done  bool // Fired or stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+// advance moves the time forward by d, firing the timers that come due in
+// order.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.done && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.done = true
+		c.now = next.at
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// testDebouncer feeds a Debouncer events through a Watcher that isn't
+// connected to the system.
+type testDebouncer struct {
+	t      *testing.T
+	deb    *Debouncer
+	clock  *fakeClock
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newTestDebouncer(t *testing.T, quiet time.Duration, opts ...Option) *testDebouncer {
+	td := &testDebouncer{
+		t:      t,
+		clock:  &fakeClock{now: time.Unix(0, 0)},
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+	w := &fsnotify.Watcher{Events: td.events, Errors: td.errors}
+	td.deb = New(w, quiet, append(opts, WithClock(td.clock))...)
+	return td
+}
+
+var errSync = errors.New("sync")
+
+// send passes events to the Debouncer, and waits for it to take them in.
+func (td *testDebouncer) send(events ...fsnotify.Event) {
+	td.t.Helper()
+	for _, event := range events {
+		td.events <- event
+	}
+	td.sync()
+}
+
+// sync waits for the Debouncer to finish what it is doing, as it only
+// receives the next error once it has.
+func (td *testDebouncer) sync() {
+	td.t.Helper()
+	td.errors <- errSync
+	if err := <-td.deb.Errors; err != errSync {
+		td.t.Fatalf("Expected %v, got %v", errSync, err)
+	}
+}
+
+// expect checks that exactly the given events are ready after advancing the
+// clock by d.
+func (td *testDebouncer) expect(d time.Duration, want ...fsnotify.Event) {
+	td.t.Helper()
+	td.clock.advance(d)
+	for _, w := range want {
+		select {
+		case got := <-td.deb.Events:
+			if got.Name != w.Name || got.Op != w.Op || got.OldName != w.OldName {
+				td.t.Fatalf("Expected %v, got %v", w, got)
+			}
+		case <-time.After(time.Second):
+			td.t.Fatalf("Took too long to wait for %v", w)
+		}
+	}
+	td.sync()
+	td.deb.mu.Lock()
+	defer td.deb.mu.Unlock()
+	if len(td.deb.ready) > 0 {
+		td.t.Fatalf("Unexpected events %v", td.deb.ready)
+	}
+}
+
+func (td *testDebouncer) close() {
+	close(td.events)
+	close(td.errors)
+	for range td.deb.Events {
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	const quiet = 100 * time.Millisecond
+	td := newTestDebouncer(t, quiet)
+	defer td.close()
+
+	// Bursts are reported once quiet, with the union of their operations.
+	td.send(
+		fsnotify.Event{Name: "a", Op: fsnotify.Write},
+		fsnotify.Event{Name: "b", Op: fsnotify.Create},
+		fsnotify.Event{Name: "a", Op: fsnotify.Chmod},
+	)
+	td.expect(quiet - time.Millisecond)
+	td.send(fsnotify.Event{Name: "a", Op: fsnotify.Write})
+	td.expect(time.Millisecond, fsnotify.Event{Name: "b", Op: fsnotify.Create})
+	td.expect(quiet, fsnotify.Event{Name: "a", Op: fsnotify.Write | fsnotify.Chmod})
+
+	// Created and removed cancel out.
+	td.send(
+		fsnotify.Event{Name: "tmp", Op: fsnotify.Create},
+		fsnotify.Event{Name: "tmp", Op: fsnotify.Write},
+		fsnotify.Event{Name: "tmp", Op: fsnotify.Remove},
+	)
+	td.expect(quiet)
+
+	// Renamed away and created again is a write.
+	td.send(
+		fsnotify.Event{Name: "a", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "a", Op: fsnotify.Create},
+		fsnotify.Event{Name: "b", Op: fsnotify.Remove},
+		fsnotify.Event{Name: "b.tmp", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "b", Op: fsnotify.Create, OldName: "b.tmp"},
+	)
+	td.expect(quiet,
+		fsnotify.Event{Name: "a", Op: fsnotify.Write},
+		fsnotify.Event{Name: "b.tmp", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "b", Op: fsnotify.Write},
+	)
+
+	// A temporary file renamed over the target is only reported for the
+	// target, as written to, or as created if it is new.
+	td.send(
+		fsnotify.Event{Name: "b.tmp", Op: fsnotify.Create},
+		fsnotify.Event{Name: "b.tmp", Op: fsnotify.Write},
+		fsnotify.Event{Name: "b.tmp", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "b", Op: fsnotify.Create, OldName: "b.tmp"},
+	)
+	td.expect(quiet, fsnotify.Event{Name: "b", Op: fsnotify.Write})
+	td.send(
+		fsnotify.Event{Name: "c", Op: fsnotify.Create},
+		fsnotify.Event{Name: "c", Op: fsnotify.Remove},
+		fsnotify.Event{Name: "c.tmp", Op: fsnotify.Create},
+		fsnotify.Event{Name: "c.tmp", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "c", Op: fsnotify.Create, OldName: "c.tmp"},
+	)
+	td.expect(quiet, fsnotify.Event{Name: "c", Op: fsnotify.Create})
+
+	// Renamed within the burst, a file that was already there is reported
+	// under both names.
+	td.send(
+		fsnotify.Event{Name: "d", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "e", Op: fsnotify.Create, OldName: "d"},
+	)
+	td.expect(quiet,
+		fsnotify.Event{Name: "d", Op: fsnotify.Rename},
+		fsnotify.Event{Name: "e", Op: fsnotify.Create, OldName: "d"},
+	)
+
+	// Removed for good is reported as such.
+	td.send(
+		fsnotify.Event{Name: "a", Op: fsnotify.Write},
+		fsnotify.Event{Name: "a", Op: fsnotify.Remove},
+	)
+	td.expect(quiet, fsnotify.Event{Name: "a", Op: fsnotify.Write | fsnotify.Remove})
+}
+
+func TestDebounceMaxLatency(t *testing.T) {
+	const quiet = 100 * time.Millisecond
+	td := newTestDebouncer(t, quiet, WithMaxLatency(250*time.Millisecond))
+	defer td.close()
+
+	// Never quiet for long enough, but reported in time anyway.
+	for i := 0; i < 2; i++ {
+		td.send(fsnotify.Event{Name: "log", Op: fsnotify.Write})
+		td.expect(90 * time.Millisecond)
+	}
+	td.send(fsnotify.Event{Name: "log", Op: fsnotify.Write})
+	td.expect(70*time.Millisecond, fsnotify.Event{Name: "log", Op: fsnotify.Write})
+
+	// And the next burst starts afresh.
+	td.send(fsnotify.Event{Name: "log", Op: fsnotify.Write})
+	td.expect(quiet, fsnotify.Event{Name: "log", Op: fsnotify.Write})
+}
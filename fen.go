@@ -13,12 +13,20 @@ import (
 
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct {
-	Events chan Event
-	Errors chan error
+	Events  chan Event
+	Batches chan []Event
+	Errors  chan error
+	queue   queue // Events and errors for Next and TryNext
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (*Watcher, error) {
+	return NewWatcherWithOptions()
+}
+
+// NewWatcherWithOptions is like NewWatcher, but allows the Watcher to be
+// configured with options.
+func NewWatcherWithOptions(opts ...WatcherOption) (*Watcher, error) {
 	return nil, errors.New("FEN based watcher not yet supported for fsnotify\n")
 }
 
@@ -32,7 +40,33 @@ func (w *Watcher) Add(name string) error {
 	return nil
 }
 
+// AddWith is like Add, but allows the watch to be configured with options.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	return nil
+}
+
+// AddRecursive is like AddWith, but also watches the directories below name.
+func (w *Watcher) AddRecursive(name string, opts ...AddOption) error {
+	return nil
+}
+
+// WatchFile starts watching the file name by its path, following it across
+// replacements.
+func (w *Watcher) WatchFile(name string) error {
+	return nil
+}
+
+// AddGlob starts watching the files and directories matching pattern.
+func (w *Watcher) AddGlob(pattern string, opts ...AddOption) error {
+	return nil
+}
+
 // Remove stops watching the the named file or directory (non-recursively).
 func (w *Watcher) Remove(name string) error {
 	return nil
 }
+
+// RemoveRecursive stops watching name and every file and directory below it.
+func (w *Watcher) RemoveRecursive(name string) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package fsnotify
+
+// Filter is a named set of patterns, with the syntax of WithExclude, for the
+// files editors and other tools leave around in passing, such as swap files,
+// backups and the temporary files written before renaming them over the
+// real one. Saving a file in most editors sends events for some of these,
+// which are rarely worth reacting to.
+//
+// Like the other options of a watch, filters are given to each AddWith,
+// AddRecursive or AddGlob call with WithFilters, rather than to the Watcher.
+type Filter struct {
+	Name     string
+	Patterns []string
+}
+
+// Extend returns a copy of f with the patterns added.
+func (f Filter) Extend(patterns ...string) Filter {
+	f.Patterns = append(append([]string(nil), f.Patterns...), patterns...)
+	return f
+}
+
+// The preset filters.
+var (
+	// VimFilter is for the swap and backup files of Vim, and the 4913 file
+	// it creates to check whether it can write to a directory.
+	VimFilter = Filter{Name: "vim", Patterns: []string{"*.swp", "*.swo", "*.swx", "*~", "4913"}}
+	// EmacsFilter is for the backup, autosave and lock files of Emacs.
+	EmacsFilter = Filter{Name: "emacs", Patterns: []string{"*~", "#*#", ".#*"}}
+	// JetBrainsFilter is for the files IntelliJ IDEA, GoLand and the other
+	// JetBrains IDEs write when saving safely.
+	JetBrainsFilter = Filter{Name: "jetbrains", Patterns: []string{"*___jb_tmp___", "*___jb_old___"}}
+	// GnomeFilter is for the temporary files of gedit and other GNOME
+	// applications, and the lock files of LibreOffice.
+	GnomeFilter = Filter{Name: "gnome", Patterns: []string{".goutputstream-*", ".~lock.*#"}}
+	// OSFilter is for the metadata files macOS and Windows drop into
+	// directories.
+	OSFilter = Filter{Name: "os", Patterns: []string{".DS_Store", "._*", "Thumbs.db", "desktop.ini"}}
+	// TempFilter is for files ending in .tmp, the name many tools and
+	// editor extensions give the file they rename over the one being saved.
+	// It isn't in PresetFilters, as it leaves out real files named so too.
+	TempFilter = Filter{Name: "temp", Patterns: []string{"*.tmp"}}
+)
+
+// PresetFilters are the preset filters that only match files tools leave
+// around, which is all of them but TempFilter.
+var PresetFilters = []Filter{VimFilter, EmacsFilter, JetBrainsFilter, GnomeFilter, OSFilter}
+
+// LookupFilter returns the preset filter with the given name, such as "vim"
+// or "temp".
+func LookupFilter(name string) (Filter, bool) {
+	for _, f := range PresetFilters {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	if name == TempFilter.Name {
+		return TempFilter, true
+	}
+	return Filter{}, false
+}
+
+// WithFilters leaves out the files matching any of the filters from the
+// watch, as WithExclude does for their patterns. Filters can be combined,
+// and extended with Extend:
+//
+//	w.AddRecursive(dir, fsnotify.WithFilters(fsnotify.PresetFilters...))
+//	w.AddWith(dir, fsnotify.WithFilters(fsnotify.VimFilter.Extend("*.bak")))
+//
+// Like WithExclude, it is only implemented on Linux.
+func WithFilters(filters ...Filter) AddOption {
+	return func(opt *watchOptions) {
+		for _, f := range filters {
+			opt.exclude.patterns = append(opt.exclude.patterns, f.Patterns...)
+		}
+	}
+}
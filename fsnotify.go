@@ -10,14 +10,72 @@ package fsnotify
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Event represents a single file system notification.
 type Event struct {
 	Name string // Relative path to the file or directory.
 	Op   Op     // File operation that triggered the event.
+
+	// IsDir reports whether the event concerns a directory. On Windows this
+	// is only known for paths that still exist when the event is read.
+	IsDir bool
+
+	// Time is when the event was read from the kernel.
+	Time time.Time
+
+	// Seq numbers the events sent by a Watcher in the order they are sent,
+	// starting at 1 with no gaps, so that code passing them on can put them
+	// back in order and tell when one of them was dropped downstream.
+	// Events the kernel loses are never numbered; they are reported with an
+	// Overflow event instead.
+	Seq uint64
+
+	// OldName is the previous path of a file or directory that was renamed
+	// within the watched tree, set on the Create event for its new path,
+	// which follows the Rename event for OldName. It is only set on Linux.
+	OldName string
+
+	move   moveKind      // How a Rename or Create relates to the watched tree.
+	reason UnwatchReason // Why the watch ended, for Unwatch events.
+	sys    interface{}   // Backend-specific details, returned by Sys.
+}
+
+// moveKind classifies the halves of a rename that could not be paired.
+type moveKind uint8
+
+const (
+	moveNone moveKind = iota
+	moveIn            // Moved in from a location that isn't watched.
+	moveOut           // Moved out to a location that isn't watched.
+)
+
+// UnwatchReason says why a watch ended.
+type UnwatchReason uint8
+
+// These are the reasons an Unwatch event can give.
+const (
+	UnwatchRemoved   UnwatchReason = iota + 1 // The watch was removed with Remove.
+	UnwatchDeleted                            // The watched file or directory was deleted.
+	UnwatchUnmounted                          // The filesystem containing it was unmounted.
+	UnwatchMoved                              // The watched file or directory was moved out of sight.
+)
+
+var unwatchReasons = map[UnwatchReason]string{
+	UnwatchRemoved:   "removed",
+	UnwatchDeleted:   "deleted",
+	UnwatchUnmounted: "unmounted",
+	UnwatchMoved:     "moved",
+}
+
+func (r UnwatchReason) String() string {
+	return unwatchReasons[r]
 }
 
 // Op describes a set of file operations.
@@ -30,26 +88,59 @@ const (
 	Remove
 	Rename
 	Chmod
+
+	// The following operations are only reported for watches that ask for
+	// them with WithOps, and only the Linux backend supports them.
+
+	Open         // A file or directory was opened.
+	Access       // A file was read.
+	CloseWrite   // A file opened for writing was closed.
+	CloseNoWrite // A file or directory not opened for writing was closed.
+
+	// Overflow is sent, with an empty Name, when the kernel's event queue
+	// overflowed and events were lost. ErrEventOverflow is also sent on the
+	// Errors channel.
+	Overflow
+
+	// The following are only sent for watches that ask for them with
+	// WithOps, and only the Linux backend supports them.
+
+	Unmount // The filesystem containing the watched path was unmounted.
+	Unwatch // The watch ended; Event.UnwatchReason says why.
 )
 
+// portableOps are the operations reported by every backend, and the ones a
+// watch reports unless told otherwise.
+const portableOps = Create | Write | Remove | Rename | Chmod
+
+// opNames lists the name of each Op, in the order String writes them.
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Remove, "REMOVE"},
+	{Write, "WRITE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+	{Open, "OPEN"},
+	{Access, "ACCESS"},
+	{CloseWrite, "CLOSE_WRITE"},
+	{CloseNoWrite, "CLOSE_NOWRITE"},
+	{Overflow, "OVERFLOW"},
+	{Unmount, "UNMOUNT"},
+	{Unwatch, "UNWATCH"},
+}
+
 func (op Op) String() string {
 	// Use a buffer for efficient string concatenation
 	var buffer bytes.Buffer
 
-	if op&Create == Create {
-		buffer.WriteString("|CREATE")
-	}
-	if op&Remove == Remove {
-		buffer.WriteString("|REMOVE")
-	}
-	if op&Write == Write {
-		buffer.WriteString("|WRITE")
-	}
-	if op&Rename == Rename {
-		buffer.WriteString("|RENAME")
-	}
-	if op&Chmod == Chmod {
-		buffer.WriteString("|CHMOD")
+	for _, o := range opNames {
+		if op&o.op == o.op {
+			buffer.WriteString("|")
+			buffer.WriteString(o.name)
+		}
 	}
 	if buffer.Len() == 0 {
 		return ""
@@ -57,14 +148,531 @@ func (op Op) String() string {
 	return buffer.String()[1:] // Strip leading pipe
 }
 
+// ParseOp parses the form written by Op.String, such as "CREATE|WRITE".
+// The empty string parses as no operations.
+func ParseOp(s string) (Op, error) {
+	var op Op
+	if s == "" {
+		return op, nil
+	}
+next:
+	for _, name := range strings.Split(s, "|") {
+		for _, o := range opNames {
+			if o.name == name {
+				op |= o.op
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("fsnotify: unknown operation %q in %q", name, s)
+	}
+	return op, nil
+}
+
+// MarshalText implements encoding.TextMarshaler using the form written by
+// String.
+func (op Op) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using ParseOp.
+func (op *Op) UnmarshalText(text []byte) error {
+	parsed, err := ParseOp(string(text))
+	if err != nil {
+		return err
+	}
+	*op = parsed
+	return nil
+}
+
 // String returns a string representation of the event in the form
-// "file: REMOVE|WRITE|..."
+// "file: REMOVE|WRITE|...". Events that carry the previous path of a rename
+// have the form "file: CREATE (from \"old\")".
 func (e Event) String() string {
+	if e.OldName != "" {
+		return fmt.Sprintf("%q: %s (from %q)", e.Name, e.Op.String(), e.OldName)
+	}
 	return fmt.Sprintf("%q: %s", e.Name, e.Op.String())
 }
 
+// Sys returns the backend-specific details of the event, or nil if there are
+// none: an *InotifyEvent on Linux, and a *unix.Kevent_t on BSD and macOS for
+// events that come straight from kqueue.
+func (e Event) Sys() interface{} {
+	return e.sys
+}
+
+// jsonEvent is the JSON form of an Event, as described by MarshalJSON.
+type jsonEvent struct {
+	Name    string     `json:"name"`
+	Op      Op         `json:"op"`
+	OldName string     `json:"oldName,omitempty"`
+	IsDir   bool       `json:"isDir,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+	Seq     uint64     `json:"seq,omitempty"`
+	Moved   string     `json:"moved,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Events are encoded as an object
+// with the fields "name", "op", "oldName", "isDir", "time", "seq", "moved"
+// and "reason", leaving out empty ones; "op" has the form written by
+// Op.String, "time" is RFC 3339 with nanoseconds, "moved" is "in" or "out"
+// when MovedIn or MovedOut reports true, and "reason" is the UnwatchReason
+// of Unwatch events. Sys is not encoded. For example:
+//
+//	{"name":"/tmp/new","op":"CREATE","oldName":"/tmp/old","isDir":true,"time":"2022-07-16T10:00:00.123456789Z","seq":42}
+func (e Event) MarshalJSON() ([]byte, error) {
+	j := jsonEvent{Name: e.Name, Op: e.Op, OldName: e.OldName, IsDir: e.IsDir, Seq: e.Seq, Reason: e.reason.String()}
+	if !e.Time.IsZero() {
+		j.Time = &e.Time
+	}
+	switch e.move {
+	case moveIn:
+		j.Moved = "in"
+	case moveOut:
+		j.Moved = "out"
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the form written by
+// MarshalJSON.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var j jsonEvent
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	ev := Event{Name: j.Name, Op: j.Op, OldName: j.OldName, IsDir: j.IsDir, Seq: j.Seq}
+	if j.Time != nil {
+		ev.Time = *j.Time
+	}
+	switch j.Moved {
+	case "":
+	case "in":
+		ev.move = moveIn
+	case "out":
+		ev.move = moveOut
+	default:
+		return fmt.Errorf("fsnotify: unknown move %q", j.Moved)
+	}
+	if j.Reason != "" {
+		for reason, name := range unwatchReasons {
+			if name == j.Reason {
+				ev.reason = reason
+			}
+		}
+		if ev.reason == 0 {
+			return fmt.Errorf("fsnotify: unknown unwatch reason %q", j.Reason)
+		}
+	}
+	*e = ev
+	return nil
+}
+
+// UnwatchReason returns why the watch ended for an Unwatch event, and 0 for
+// any other event.
+func (e Event) UnwatchReason() UnwatchReason {
+	return e.reason
+}
+
+// MovedIn reports whether e is a Create event for a file or directory that
+// was moved into the watched tree from a location that isn't watched.
+func (e Event) MovedIn() bool {
+	return e.move == moveIn
+}
+
+// MovedOut reports whether e is a Rename event for a file or directory that
+// was moved out of the watched tree, so its new location is unknown.
+func (e Event) MovedOut() bool {
+	return e.move == moveOut
+}
+
+// An AddOption configures a watch added with AddWith.
+type AddOption func(*watchOptions)
+
+type watchOptions struct {
+	ops      Op
+	resync   bool
+	exclude  exclusion
+	maxDepth int // Negative for no limit
+	maxDirs  int // Zero for no limit
+	pending  bool
+}
+
+// WithOps sets the operations a watch reports. By default a watch reports
+// Create, Write, Remove, Rename and Chmod; Open, Access, CloseWrite,
+// CloseNoWrite, Unmount and Unwatch are only reported when asked for here.
+// Backends that can't report an operation make AddWith fail with
+// ErrUnsupportedOp.
+//
+// The filter is passed on to the kernel as far as the backend allows, so a
+// watch that only wants Create isn't woken up by writes. Adding the same path
+// again widens the watch to the union of the operations asked for.
+func WithOps(ops Op) AddOption {
+	return func(opt *watchOptions) {
+		opt.ops = ops
+	}
+}
+
+// WithResync keeps a listing of a watched directory so that, after an
+// Overflow, the Watcher re-reads the directory and sends Create, Remove and
+// Write events for whatever changed since. It is only implemented on Linux,
+// and is ignored elsewhere.
+func WithResync() AddOption {
+	return func(opt *watchOptions) {
+		opt.resync = true
+	}
+}
+
+// WithExclude leaves out the files and directories matching any of the
+// patterns, which have the syntax of filepath.Match. A pattern without a path
+// separator, such as ".git" or "*.swp", is matched against the base name of
+// each entry; other patterns, such as "build/*.o", against its path relative
+// to the directory passed to AddWith or AddRecursive.
+//
+// No events are sent for excluded entries, and AddRecursive doesn't watch
+// excluded directories or anything below them, so they use up no watches.
+// Adding the same path again replaces its exclusions, but those of a tree it
+// is part of keep applying to it as well. It is only implemented on Linux;
+// other backends make AddWith fail with ErrNotSupported.
+func WithExclude(patterns ...string) AddOption {
+	return func(opt *watchOptions) {
+		opt.exclude.patterns = append(opt.exclude.patterns, patterns...)
+	}
+}
+
+// WithExcludeFunc is like WithExclude, but leaves out the files and
+// directories for which exclude returns true. It is called with the path an
+// event would have as its Name, from the goroutine reading events, so it
+// must be fast and must not block.
+func WithExcludeFunc(exclude func(path string, isDir bool) bool) AddOption {
+	return func(opt *watchOptions) {
+		opt.exclude.funcs = append(opt.exclude.funcs, exclude)
+	}
+}
+
+// exclusion holds the rules given with WithExclude, WithExcludeFunc and
+// WithGitignore.
+type exclusion struct {
+	patterns []string
+	funcs    []func(path string, isDir bool) bool
+	git      *gitignore
+}
+
+func (x exclusion) empty() bool {
+	return len(x.patterns) == 0 && len(x.funcs) == 0 && x.git == nil
+}
+
+// check returns an error wrapping filepath.ErrBadPattern if a pattern is
+// malformed.
+func (x exclusion) check() error {
+	for _, pattern := range x.patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+	return nil
+}
+
+// excludes reports whether path, found below the watched directory root,
+// is excluded.
+func (x exclusion) excludes(root, path string, isDir bool) bool {
+	if len(x.patterns) > 0 {
+		base := filepath.Base(path)
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+		for _, pattern := range x.patterns {
+			target := rel
+			if !strings.ContainsRune(pattern, filepath.Separator) {
+				target = base
+			}
+			if ok, _ := filepath.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+	for _, exclude := range x.funcs {
+		if exclude(path, isDir) {
+			return true
+		}
+	}
+	return x.git != nil && x.git.ignored(path, isDir)
+}
+
+// WithPending lets AddWith watch a path that doesn't exist yet. Until it
+// does, the Watcher watches the nearest ancestor that exists, following the
+// path down as its directories are created; once the path appears it is
+// watched with the other options and a Create event is sent for it. If it is
+// deleted later, the watch goes back to waiting for it instead of ending.
+// Remove stops waiting. It is only implemented on Linux; other backends make
+// AddWith fail with ErrNotSupported.
+func WithPending() AddOption {
+	return func(opt *watchOptions) {
+		opt.pending = true
+	}
+}
+
+// WithMaxDepth stops AddRecursive from watching directories more than n
+// levels below the one it was called with; with 0 only that directory is
+// watched. A negative n, the default, means no limit.
+func WithMaxDepth(n int) AddOption {
+	return func(opt *watchOptions) {
+		opt.maxDepth = n
+	}
+}
+
+// WithMaxDirs limits AddRecursive to watching n directories of the tree,
+// counting those picked up later. Subtrees that don't fit are skipped and
+// reported with a *LimitError. Zero, the default, means no limit.
+func WithMaxDirs(n int) AddOption {
+	return func(opt *watchOptions) {
+		opt.maxDirs = n
+	}
+}
+
+func getOptions(opts ...AddOption) watchOptions {
+	with := watchOptions{ops: portableOps, maxDepth: -1}
+	for _, o := range opts {
+		o(&with)
+	}
+	return with
+}
+
+// A WatcherOption configures a Watcher created with NewWatcherWithOptions.
+type WatcherOption func(*watcherOptions)
+
+type watcherOptions struct {
+	budget     int  // Zero for no limit
+	events     int  // Capacity of the Events channel, negative for the default
+	batches    bool // Send events on Batches instead of Events
+	readBuffer int  // Size of the buffer read from the kernel, zero for the default
+}
+
+// WithWatchBudget limits the Watcher to n watches in all, so that it can't
+// use up the watches the system allows every process of the user. Adding a
+// watch beyond the budget fails with ErrWatchLimitReached, and AddRecursive
+// skips the subtrees that don't fit and reports them with a *LimitError.
+// Zero, the default, means no limit. It is only enforced on Linux.
+func WithWatchBudget(n int) WatcherOption {
+	return func(opt *watcherOptions) {
+		opt.budget = n
+	}
+}
+
+// WithEventBuffer gives the Events channel a capacity of n, so that bursts of
+// events don't stall reading from the kernel while the receiver catches up,
+// which could make the kernel drop events. By default it is unbuffered,
+// except on Windows, where it holds 50 events. The Batches channel gets the
+// same capacity, counted in batches.
+func WithEventBuffer(n int) WatcherOption {
+	return func(opt *watcherOptions) {
+		opt.events = n
+	}
+}
+
+// WithReadBuffer sets the size in bytes of the buffer the Watcher reads
+// events from the kernel into, which bounds how many it takes in at once.
+// It is 64KiB by default on Linux, where it is raised to fit at least one
+// event with the longest name. On Windows it is the buffer of every watched
+// directory, 4KiB by default, and with kqueue it holds 10 events by default.
+func WithReadBuffer(size int) WatcherOption {
+	return func(opt *watcherOptions) {
+		opt.readBuffer = size
+	}
+}
+
+// WithBatches sends events on the Batches channel rather than Events, in
+// slices holding all the events from one read from the kernel, so that a
+// burst, such as from a git checkout, can be handled in one go and without
+// passing every event between goroutines. Nothing is sent on Events.
+// Next, TryNext and Run take events from the batches.
+func WithBatches() WatcherOption {
+	return func(opt *watcherOptions) {
+		opt.batches = true
+	}
+}
+
+func getWatcherOptions(opts ...WatcherOption) watcherOptions {
+	with := watcherOptions{events: -1}
+	for _, o := range opts {
+		o(&with)
+	}
+	return with
+}
+
+// eventBuffer returns the capacity of the Events channel, which is def if
+// WithEventBuffer wasn't given.
+func (o watcherOptions) eventBuffer(def int) int {
+	if o.events < 0 {
+		return def
+	}
+	return o.events
+}
+
+// readBufferSize returns the size of the buffer to read from the kernel
+// into, which is def if WithReadBuffer wasn't given and at least min.
+func (o watcherOptions) readBufferSize(def, min int) int {
+	size := o.readBuffer
+	if size <= 0 {
+		size = def
+	}
+	if size < min {
+		size = min
+	}
+	return size
+}
+
+// globPattern is a pattern given to AddGlob, split into the directory it
+// starts from and the components of the rest.
+type globPattern struct {
+	root  string   // Longest leading directory without wildcards
+	parts []string // Components of the pattern below root
+}
+
+// parseGlob splits pattern, and returns an error wrapping
+// filepath.ErrBadPattern if it is malformed.
+func parseGlob(pattern string) (globPattern, error) {
+	pattern = filepath.Clean(pattern)
+	parts := strings.Split(pattern, string(filepath.Separator))
+	literal := 0
+	for literal < len(parts) && !strings.ContainsAny(parts[literal], `*?[\`) {
+		literal++
+	}
+	if literal == len(parts) {
+		// Nothing to expand, but the directory is watched all the same.
+		literal--
+	}
+	for _, part := range parts[literal:] {
+		if _, err := filepath.Match(part, ""); err != nil && part != "**" {
+			return globPattern{}, fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+
+	root := strings.Join(parts[:literal], string(filepath.Separator))
+	switch {
+	case root == "" && filepath.IsAbs(pattern):
+		root = string(filepath.Separator)
+	case root == "":
+		root = "."
+	}
+	return globPattern{root: root, parts: parts[literal:]}, nil
+}
+
+// split returns the components of path below g.root, or false if it isn't
+// below it.
+func (g globPattern) split(path string) ([]string, bool) {
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	if rel == "." {
+		return nil, true
+	}
+	return strings.Split(rel, string(filepath.Separator)), true
+}
+
+// match reports whether path matches the pattern.
+func (g globPattern) match(path string) bool {
+	name, ok := g.split(path)
+	return ok && matchParts(g.parts, name, false)
+}
+
+// canMatchBelow reports whether anything below the directory dir could
+// match the pattern.
+func (g globPattern) canMatchBelow(dir string) bool {
+	name, ok := g.split(dir)
+	return ok && matchParts(g.parts, name, true)
+}
+
+// matchParts matches the components of a path against those of a pattern,
+// where "**" stands for any number of components. With prefix set it reports
+// whether name could be the start of a match instead.
+func matchParts(pattern, name []string, prefix bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if prefix {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:], false) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return prefix
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0 && !prefix
+}
+
+// inTree reports whether path is root or lies below it.
+func inTree(root, path string) bool {
+	if path == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, root)
+}
+
 // Common errors that can be reported by a watcher
 var (
-	ErrNonExistentWatch = errors.New("can't remove non-existent watcher")
-	ErrEventOverflow    = errors.New("fsnotify queue overflow")
+	ErrNonExistentWatch  = errors.New("can't remove non-existent watcher")
+	ErrEventOverflow     = errors.New("fsnotify queue overflow")
+	ErrUnsupportedOp     = errors.New("operation not supported on this platform")
+	ErrClosed            = errors.New("watcher already closed")
+	ErrWatchLimitReached = errors.New("watch limit reached")
+	ErrNotSupported      = errors.New("not supported on this platform")
 )
+
+// A WatchError records an error and the operation and path that caused it.
+// Add, AddWith and Remove return them, and they are sent on the Errors
+// channel when reading events fails.
+type WatchError struct {
+	Op   string // Operation that failed: "add", "remove" or "read".
+	Path string // Path the operation was for; empty for "read".
+	Err  error  // Underlying error, such as a syscall.Errno or ErrClosed.
+}
+
+func (e *WatchError) Error() string {
+	if e.Path == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// A LimitError reports the directories AddRecursive left unwatched because
+// a limit was reached: WithMaxDirs, WithWatchBudget or the system's own.
+// The rest of the tree is watched. It is returned wrapped in a *WatchError,
+// or sent on the Errors channel for directories created later.
+type LimitError struct {
+	Skipped []string // Directories not watched, each with everything below it
+	Err     error    // Limit that was reached, matching ErrWatchLimitReached
+}
+
+func (e *LimitError) Error() string {
+	const max = 10
+	skipped := e.Skipped
+	more := ""
+	if len(skipped) > max {
+		skipped, more = skipped[:max], fmt.Sprintf(" and %d more", len(skipped)-max)
+	}
+	return fmt.Sprintf("%v; skipped %s%s", e.Err, strings.Join(skipped, ", "), more)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
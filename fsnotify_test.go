@@ -8,17 +8,22 @@
 package fsnotify
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func TestEventStringWithValue(t *testing.T) {
 	for opMask, expectedString := range map[Op]string{
-		Chmod | Create: `"/usr/someFile": CREATE|CHMOD`,
-		Rename:         `"/usr/someFile": RENAME`,
-		Remove:         `"/usr/someFile": REMOVE`,
-		Write | Chmod:  `"/usr/someFile": WRITE|CHMOD`,
+		Chmod | Create:    `"/usr/someFile": CREATE|CHMOD`,
+		Rename:            `"/usr/someFile": RENAME`,
+		Remove:            `"/usr/someFile": REMOVE`,
+		Write | Chmod:     `"/usr/someFile": WRITE|CHMOD`,
+		Open | CloseWrite: `"/usr/someFile": OPEN|CLOSE_WRITE`,
 	} {
 		event := Event{Name: "/usr/someFile", Op: opMask}
 		if event.String() != expectedString {
@@ -69,3 +74,227 @@ func TestWatcherClose(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParseOp(t *testing.T) {
+	for _, op := range []Op{0, Create, Write | Chmod, Rename | CloseNoWrite | Overflow} {
+		text, err := op.MarshalText()
+		if err != nil {
+			t.Fatalf("MarshalText(%v) failed: %v", op, err)
+		}
+		var parsed Op
+		if err := parsed.UnmarshalText(text); err != nil {
+			t.Fatalf("UnmarshalText(%q) failed: %v", text, err)
+		}
+		if parsed != op {
+			t.Fatalf("Expected %v, got: %v", op, parsed)
+		}
+	}
+
+	if _, err := ParseOp("CREATE|DELETE"); err == nil {
+		t.Fatalf("Expected an error for an unknown operation")
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	event := Event{
+		Name:    "/usr/newFile",
+		OldName: "/usr/someFile",
+		Op:      Create,
+		IsDir:   true,
+		Time:    time.Date(2022, 7, 16, 10, 0, 0, 123456789, time.UTC),
+		Seq:     42,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `{"name":"/usr/newFile","op":"CREATE","oldName":"/usr/someFile","isDir":true,"time":"2022-07-16T10:00:00.123456789Z","seq":42}`
+	if string(data) != expected {
+		t.Fatalf("Expected %s, got: %s", expected, data)
+	}
+
+	var decoded Event
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded != event {
+		t.Fatalf("Expected %#v, got: %#v", event, decoded)
+	}
+
+	for _, event := range []Event{
+		{Name: "/usr/someFile", Op: Rename, move: moveOut},
+		{Name: "/usr", Op: Unwatch, reason: UnwatchUnmounted},
+	} {
+		data, err = json.Marshal(event)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		decoded = Event{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if decoded != event {
+			t.Fatalf("Expected %#v, got: %#v", event, decoded)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		match, below  bool
+	}{
+		{"/logs/*.log", "/logs/app.log", true, false},
+		{"/logs/*.log", "/logs/app.txt", false, false},
+		{"/logs/*.log", "/logs/old", false, false},
+		{"/logs/*/app.log", "/logs/2022", false, true},
+		{"/src/**/*.go", "/src/main.go", true, true},
+		{"/src/**/*.go", "/src/a/b/main.go", true, true},
+		{"/src/**/*.go", "/src/a/b", false, true},
+		{"/src/**/*.go", "/other/main.go", false, false},
+		{"conf.d/*.yaml", "conf.d/app.yaml", true, false},
+	} {
+		g, err := parseGlob(tc.pattern)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tc.pattern, err)
+		}
+		if match := g.match(tc.path); match != tc.match {
+			t.Errorf("Expected match(%q, %q) to be %t", tc.pattern, tc.path, tc.match)
+		}
+		if below := g.canMatchBelow(tc.path); below != tc.below {
+			t.Errorf("Expected canMatchBelow(%q, %q) to be %t", tc.pattern, tc.path, tc.below)
+		}
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "fsnotify")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	subDir := filepath.Join(testDir, "sub")
+	if err := os.MkdirAll(filepath.Join(testDir, ".git"), 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.MkdirAll(subDir, 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	for name, data := range map[string]string{
+		filepath.Join(testDir, ".gitignore"): "# objects\n*.o\n!keep.o\n/build\ndocs/**/*.tmp\nlogs/\n\\#notes\n",
+		filepath.Join(subDir, ".gitignore"):  "!main.o\n",
+	} {
+		if err := ioutil.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	git := &gitignore{}
+	git.init(subDir)
+	for _, tc := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.o", false, true},
+		{"sub/x/a.o", false, true},
+		{"keep.o", false, false},
+		{"sub/main.o", false, false},
+		{"build", true, true},
+		{"build/main", false, true},
+		{"sub/build", true, false},
+		{"docs/a/b/c.tmp", false, true},
+		{"docs/c.tmp", false, true},
+		{"logs", false, false},
+		{"logs", true, true},
+		{"logs/today.txt", false, true},
+		{"#notes", false, true},
+		{".git/HEAD", false, true},
+		{"main.go", false, false},
+	} {
+		path := filepath.Join(testDir, filepath.FromSlash(tc.path))
+		if ignored := git.ignored(path, tc.isDir); ignored != tc.ignored {
+			t.Errorf("Expected ignored(%q, %t) to be %t", tc.path, tc.isDir, tc.ignored)
+		}
+	}
+}
+
+func TestGitignoreLinkedWorkTree(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "fsnotify")
+	if err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// A work tree added with git worktree, whose .git file points into the
+	// git directory of the main work tree.
+	gitDir := filepath.Join(testDir, "main", ".git")
+	linkDir := filepath.Join(gitDir, "worktrees", "wt")
+	workTree := filepath.Join(testDir, "wt")
+	srcDir := filepath.Join(workTree, "src")
+	for _, dir := range []string{filepath.Join(gitDir, "info"), linkDir, srcDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	for name, data := range map[string]string{
+		filepath.Join(workTree, ".git"):          "gitdir: " + linkDir + "\n",
+		filepath.Join(linkDir, "commondir"):      "../..\n",
+		filepath.Join(gitDir, "info", "exclude"): "secret.txt\n",
+	} {
+		if err := ioutil.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	git := &gitignore{}
+	git.init(srcDir)
+	if !git.ignored(filepath.Join(srcDir, "secret.txt"), false) {
+		t.Errorf("Expected the exclude file of the main git directory to apply")
+	}
+	if git.ignored(filepath.Join(srcDir, "main.go"), false) {
+		t.Errorf("Expected main.go to be kept")
+	}
+	if !git.owns(filepath.Join(gitDir, "info", "exclude")) {
+		t.Errorf("Expected the exclude file to be read")
+	}
+	expected := []string{workTree, filepath.Join(gitDir, "info")}
+	if dirs := git.dirs(); fmt.Sprint(dirs) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q to be watched for ignore files, got %q", expected, dirs)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	vim, ok := LookupFilter("vim")
+	if !ok {
+		t.Fatalf("Expected the vim filter to exist")
+	}
+	with := getOptions(WithFilters(PresetFilters...), WithFilters(vim.Extend("*.bak")))
+	if err := with.exclude.check(); err != nil {
+		t.Fatalf("Bad pattern in filters: %v", err)
+	}
+	for _, name := range []string{
+		".main.go.swp", "main.go~", "4913", "#main.go#", ".#main.go",
+		"main.go___jb_tmp___", ".goutputstream-ABC123",
+		".~lock.report.odt#", ".DS_Store", "main.go.bak",
+	} {
+		if !with.exclude.excludes("/src", filepath.Join("/src", name), false) {
+			t.Errorf("Expected %q to be left out", name)
+		}
+	}
+	for _, name := range []string{"main.go", "data.tmp"} {
+		if with.exclude.excludes("/src", filepath.Join("/src", name), false) {
+			t.Errorf("Expected %q to be kept", name)
+		}
+	}
+	temp, ok := LookupFilter("temp")
+	if !ok {
+		t.Fatalf("Expected the temp filter to exist")
+	}
+	if with := getOptions(WithFilters(temp)); !with.exclude.excludes("/src", "/src/main.go.tmp", false) {
+		t.Errorf("Expected %q to be left out by the temp filter", "main.go.tmp")
+	}
+	if len(vim.Patterns) != len(VimFilter.Patterns) {
+		t.Errorf("Extend changed the filter it was called on")
+	}
+}
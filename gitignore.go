@@ -0,0 +1,253 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package fsnotify
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithGitignore leaves out the files and directories git ignores: those
+// matched by the .gitignore files of the work tree, including the ones in
+// directories above the watched one, and by the info/exclude file of the git
+// directory, which .git may point to in a linked work tree or submodule. The
+// .git directory itself is always left out. Changes to the ignore files are
+// picked up as they happen, watching and unwatching directories as needed;
+// the directories above the watched one and the info directory are watched
+// for that, without being reported on or listed by WatchList.
+//
+// Like WithExclude, it is only implemented on Linux.
+func WithGitignore() AddOption {
+	return func(opt *watchOptions) {
+		opt.exclude.git = &gitignore{}
+	}
+}
+
+// gitignore holds the rules of the ignore files of a git work tree, loaded as
+// they are needed.
+type gitignore struct {
+	mu     sync.Mutex
+	dir    string                  // Watched path
+	root   string                  // Top of the work tree, or the watched path outside of one
+	gitDir string                  // Directory holding info/exclude, if in a work tree
+	rules  map[string][]ignoreRule // Rules of the ignore file of each directory (key: directory)
+}
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	parts   []string // Components of the pattern, with "**" for any number
+	negate  bool     // Re-includes what it matches
+	dirOnly bool     // Only matches directories
+}
+
+// init finds the work tree dir is in. It is a no-op after the first call.
+func (g *gitignore) init(dir string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.root != "" {
+		return
+	}
+	g.rules = make(map[string][]ignoreRule)
+	g.dir, g.root = dir, dir
+	for d := dir; ; d = filepath.Dir(d) {
+		dotGit := filepath.Join(d, ".git")
+		if fi, err := os.Lstat(dotGit); err == nil {
+			g.root = d
+			g.gitDir = dotGit
+			if !fi.IsDir() {
+				g.gitDir = commonDir(dotGit)
+			}
+			return
+		}
+		if d == filepath.Dir(d) {
+			return
+		}
+	}
+}
+
+// commonDir returns the git directory the .git file dotGit of a linked work
+// tree or submodule points to, or rather the directory it shares info/exclude
+// with, if any. It returns "" if dotGit can't be read.
+func commonDir(dotGit string) string {
+	data, err := ioutil.ReadFile(dotGit)
+	if err != nil || !bytes.HasPrefix(data, []byte("gitdir:")) {
+		return ""
+	}
+	dir := strings.TrimSpace(string(data[len("gitdir:"):]))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(dotGit), dir)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(dir, common)
+		}
+		return filepath.Clean(common)
+	}
+	return filepath.Clean(dir)
+}
+
+// excludeFile returns the path of the exclude file of the work tree, or ""
+// if there is none. Must be called with g.mu held.
+func (g *gitignore) excludeFile() string {
+	if g.gitDir == "" {
+		return ""
+	}
+	return filepath.Join(g.gitDir, "info", "exclude")
+}
+
+// dirs returns the directories holding ignore files that apply to the
+// watched path without being watched with it: those from the top of the
+// work tree down to the parent of the watched path, and the one holding the
+// exclude file.
+func (g *gitignore) dirs() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var dirs []string
+	for d := g.dir; d != g.root; {
+		d = filepath.Dir(d)
+		dirs = append(dirs, d)
+	}
+	if exclude := g.excludeFile(); exclude != "" {
+		dirs = append(dirs, filepath.Dir(exclude))
+	}
+	return dirs
+}
+
+// owns reports whether path is one of the ignore files g reads.
+func (g *gitignore) owns(path string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.root == "" {
+		return false
+	}
+	if exclude := g.excludeFile(); exclude != "" && path == exclude {
+		return true
+	}
+	return filepath.Base(path) == ".gitignore" && inTree(g.root, path)
+}
+
+// forget drops the rules loaded from the ignore file path, so that they are
+// read again when next needed.
+func (g *gitignore) forget(path string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if filepath.Base(path) == "exclude" {
+		delete(g.rules, "")
+	} else {
+		delete(g.rules, filepath.Dir(path))
+	}
+}
+
+// ignored reports whether git ignores path, or any directory it is in.
+func (g *gitignore) ignored(path string, isDir bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.root == "" || !inTree(g.root, path) || path == g.root {
+		return false
+	}
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := range parts {
+		if parts[i] == ".git" {
+			return true
+		}
+		if g.match(parts[:i+1], isDir || i < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// match applies the rules to the path with the components parts below the
+// root, the last matching rule deciding. Must be called with g.mu held.
+func (g *gitignore) match(parts []string, isDir bool) bool {
+	ignored := false
+	apply := func(rules []ignoreRule, name []string) {
+		for _, rule := range rules {
+			if (!rule.dirOnly || isDir) && matchParts(rule.parts, name, false) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	// The exclude file comes first, so the ignore files take precedence,
+	// and deeper ones over those above them.
+	if exclude := g.excludeFile(); exclude != "" {
+		apply(g.load("", exclude), parts)
+	}
+	dir := g.root
+	for i := range parts {
+		apply(g.load(dir, filepath.Join(dir, ".gitignore")), parts[i:])
+		dir = filepath.Join(dir, parts[i])
+	}
+	return ignored
+}
+
+// load returns the rules of the ignore file at path, which are cached under
+// key. Must be called with g.mu held.
+func (g *gitignore) load(key, path string) []ignoreRule {
+	rules, ok := g.rules[key]
+	if !ok {
+		data, _ := ioutil.ReadFile(path)
+		rules = parseIgnoreFile(data)
+		g.rules[key] = rules
+	}
+	return rules
+}
+
+// parseIgnoreFile parses the lines of an ignore file, as described by
+// gitignore(5).
+func parseIgnoreFile(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// Trailing spaces are ignored unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+
+		var rule ignoreRule
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// A pattern with a slash is relative to the directory of the
+		// ignore file; others match at any depth below it.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		rule.parts = strings.Split(line, "/")
+		if !anchored {
+			rule.parts = append([]string{"**"}, rule.parts...)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -11,10 +11,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -24,31 +28,60 @@ import (
 type Watcher struct {
 	fd          int // https://github.com/golang/go/issues/26439 can't call .Fd() on os.FIle or Read will no longer return on Close()
 	Events      chan Event
+	Batches     chan []Event // Events from each read, with WithBatches
 	Errors      chan error
 	mu          sync.Mutex // Map access
 	inotifyFile *os.File
-	watches     map[string]*watch // Map of inotify watches (key: path)
-	paths       map[int]string    // Map of watched paths (key: watch descriptor)
-	done        chan struct{}     // Channel for sending a "quit message" to the reader goroutine
-	doneResp    chan struct{}     // Channel to respond to Close
+	watches     map[string]*watch        // Map of inotify watches (key: path)
+	paths       map[int]string           // Map of watched paths (key: watch descriptor)
+	ending      map[int]ending           // Watches waiting for their IN_IGNORED to send Unwatch (key: watch descriptor)
+	kept        []Event                  // Unwatch events for watches keepInternal kept, for readEvents to send
+	recursive   map[string]*tree         // Trees added with AddRecursive (key: root path)
+	pending     map[string]*pendingWatch // Watches added WithPending waiting for their path (key: path)
+	files       map[string]*fileWatch    // Files watched with WatchFile (key: path)
+	globs       map[string]*globWatch    // Patterns watched with AddGlob (key: pattern)
+	done        chan struct{}            // Channel for sending a "quit message" to the reader goroutine
+	doneResp    chan struct{}            // Channel to respond to Close
+	seq         uint64                   // Sequence number of the last event sent (only used by readEvents)
+	budget      int                      // Maximum number of watches, from WithWatchBudget
+	readBuffer  int                      // Size of the buffer events are read into, from WithReadBuffer
+	queue       queue                    // Events and errors for Next and TryNext
+	batching    bool                     // Set by WithBatches
+	batch       []Event                  // Events read but not yet sent on Batches (only used by readEvents)
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (*Watcher, error) {
+	return NewWatcherWithOptions()
+}
+
+// NewWatcherWithOptions is like NewWatcher, but allows the Watcher to be
+// configured with options.
+func NewWatcherWithOptions(opts ...WatcherOption) (*Watcher, error) {
 	// Create inotify fd
 	// Need to set the FD to nonblocking mode in order for SetDeadline methods to work
 	// Otherwise, blocking i/o operations won't terminate on close
+	with := getWatcherOptions(opts...)
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if fd == -1 {
 		return nil, errno
 	}
 
 	w := &Watcher{
+		budget:      with.budget,
+		readBuffer:  with.readBufferSize(unix.SizeofInotifyEvent*4096, unix.SizeofInotifyEvent+unix.NAME_MAX+1),
 		fd:          fd,
 		inotifyFile: os.NewFile(uintptr(fd), ""),
 		watches:     make(map[string]*watch),
 		paths:       make(map[int]string),
-		Events:      make(chan Event),
+		ending:      make(map[int]ending),
+		recursive:   make(map[string]*tree),
+		pending:     make(map[string]*pendingWatch),
+		files:       make(map[string]*fileWatch),
+		globs:       make(map[string]*globWatch),
+		Events:      make(chan Event, with.eventBuffer(0)),
+		Batches:     make(chan []Event, with.eventBuffer(0)),
+		batching:    with.batches,
 		Errors:      make(chan error),
 		done:        make(chan struct{}),
 		doneResp:    make(chan struct{}),
@@ -90,107 +123,1319 @@ func (w *Watcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *Watcher) Add(name string) error {
+	return w.AddWith(name)
+}
+
+// AddWith is like Add, but allows the watch to be configured with options.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
 	name = filepath.Clean(name)
 	if w.isClosed() {
-		return errors.New("inotify instance already closed")
+		return &WatchError{Op: "add", Path: name, Err: ErrClosed}
 	}
 
-	const agnosticEvents = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
-		unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
-		unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
+	with := getOptions(opts...)
+	if err := with.exclude.check(); err != nil {
+		return &WatchError{Op: "add", Path: name, Err: err}
+	}
 
-	var flags uint32 = agnosticEvents
+	if with.exclude.git != nil {
+		with.exclude.git.init(name)
+	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	var old exclusion
+	if watch := w.watches[name]; watch != nil {
+		old = watch.exclude
+	}
+	w.watchIgnores(with.exclude)
+	var err error
+	if with.pending {
+		_, err = w.resume(&pendingWatch{name: name, with: with})
+	} else {
+		var watch *watch
+		if watch, err = w.addWatch(name, with, 0); err == nil {
+			watch.exclude = with.exclude
+		}
+	}
+	w.releaseIgnores(old)
+	w.releaseIgnores(with.exclude)
+	return err
+}
+
+// pendingWatch is a watch added WithPending.
+type pendingWatch struct {
+	name   string       // Path to watch
+	with   watchOptions // Options to watch it with
+	anchor string       // Ancestor watched while name doesn't exist, if any
+}
+
+// anchorMask is what the watch on the ancestor of a pending watch asks for,
+// to learn when the next directory on the way down appears.
+const anchorMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// resume watches the path of p if it exists, and otherwise its nearest
+// ancestor that does, until it appears. It reports whether the path itself
+// is watched. Must be called with w.mu held.
+func (w *Watcher) resume(p *pendingWatch) (bool, error) {
+	for {
+		watch, err := w.addWatch(p.name, p.with, 0)
+		if err == nil {
+			watch.exclude = p.with.exclude
+			watch.pending = p
+			delete(w.pending, p.name)
+			w.releaseAnchor(p)
+			return true, nil
+		}
+		if !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ENOTDIR) {
+			return false, err
+		}
+
+		anchor := filepath.Dir(p.name)
+		for anchor != filepath.Dir(anchor) {
+			if fi, err := os.Stat(anchor); err == nil && fi.IsDir() {
+				break
+			}
+			anchor = filepath.Dir(anchor)
+		}
+		if anchor == p.anchor {
+			w.pending[p.name] = p
+			return false, nil
+		}
+
+		if err := w.addInternal(anchor, anchorMask); err != nil {
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+				// Gone again already; look for another one.
+				continue
+			}
+			return false, err
+		}
+		w.releaseAnchor(p)
+		p.anchor = anchor
+		w.pending[p.name] = p
+		// Go round again, as the next directory down may have been
+		// created before the anchor was watched.
+	}
+}
+
+// releaseAnchor stops watching the ancestor p was waiting on, unless it is
+// watched for another reason. Must be called with w.mu held.
+func (w *Watcher) releaseAnchor(p *pendingWatch) {
+	anchor := p.anchor
+	p.anchor = ""
+	if anchor != "" {
+		w.releaseInternal(anchor)
+	}
+}
+
+// addInternal watches dir for the flags in mask on behalf of the Watcher
+// itself, keeping it out of WatchList unless it is watched by the user as
+// well. Must be called with w.mu held.
+func (w *Watcher) addInternal(dir string, mask uint32) error {
+	internal := true
+	if existing := w.watches[dir]; existing != nil {
+		internal = existing.internal
+	}
+	watch, err := w.addWatch(dir, watchOptions{}, mask)
+	if err != nil {
+		return err
+	}
+	watch.internal = internal
+	return nil
+}
+
+// releaseInternal stops watching dir if it was only watched by addInternal
+// and no pending watch, file watched with WatchFile, pattern or ignore file
+// needs it anymore. Must be called with w.mu held.
+func (w *Watcher) releaseInternal(dir string) {
+	watch := w.watches[dir]
+	if watch == nil || !watch.internal || w.needsInternal(dir, watch) {
+		return
+	}
+	w.dropWatch(int(watch.wd), dir)
+	_, _ = unix.InotifyRmWatch(w.fd, watch.wd)
+}
+
+// needsInternal reports whether a pending watch, file watched with WatchFile,
+// pattern or ignore file needs the watch on dir. Must be called with w.mu
+// held.
+func (w *Watcher) needsInternal(dir string, watch *watch) bool {
+	for _, p := range w.pending {
+		if p.anchor == dir {
+			return true
+		}
+	}
+	for _, f := range w.files {
+		if f.dirs[dir] {
+			return true
+		}
+	}
+	for _, g := range w.globs {
+		if g.dirs[dir] {
+			return true
+		}
+	}
+	return watch.flags&ignoreMask == ignoreMask && w.needsIgnoreDir(dir)
+}
+
+// keepInternal turns the watch on name back into one only watched by
+// addInternal if needsInternal says it is still needed, rather than letting
+// Remove take it away from the kernel, and reports whether it did. As no
+// IN_IGNORED will come for it, its Unwatch event is handed to readEvents
+// directly. Must be called with w.mu held.
+func (w *Watcher) keepInternal(name string, watch *watch, reason UnwatchReason) bool {
+	if !w.needsInternal(name, watch) {
+		return false
+	}
+	if watch.ops&Unwatch == Unwatch {
+		w.kept = append(w.kept, Event{Name: name, Op: Unwatch, reason: reason, Time: time.Now()})
+		// Wake readEvents up to send it.
+		_ = w.inotifyFile.SetReadDeadline(time.Now())
+	}
+	if watch.tree != nil {
+		watch.tree.dirs--
+	}
+	watch.ops, watch.internal = 0, true
+	watch.exclude, watch.listing, watch.tree, watch.pending = exclusion{}, nil, nil, nil
+	return true
+}
+
+// WatchFile starts watching the file name by its path rather than by the file
+// it currently is. The directories along the way to it, following symbolic
+// links, are watched instead of the file itself, so the watch carries on when
+// the file is replaced by renaming another over it, as editors do, or when a
+// link on the way is swapped to point elsewhere, as Kubernetes does for
+// ConfigMap volumes.
+//
+// A single Write event is sent with Name set to name each time the file name
+// leads to is replaced or closed after writing, Create when it appears, and
+// Remove when it goes away; the watch waits for it to come back. Remove
+// stops the watch.
+func (w *Watcher) WatchFile(name string) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return &WatchError{Op: "add", Path: name, Err: ErrClosed}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.files[name]; ok {
+		return nil
+	}
+	f := &fileWatch{name: name}
+	w.files[name] = f
+	if _, err := w.follow(f); err != nil {
+		w.unwatchFile(f)
+		return err
+	}
+	return nil
+}
+
+// AddGlob starts watching the files and directories matching pattern, which
+// has the syntax of filepath.Match with the addition of "**" as a whole path
+// component matching any number of directories, as in "src/**/*.go".
+//
+// Only the directories that can contain a match are watched, starting from
+// the longest leading directory of pattern without wildcards, which must
+// exist. Directories created there later are watched as well, and Create
+// events are sent for the matches they already contain. Only events for
+// paths matching pattern are sent. The options are those of AddWith, and
+// Remove with the same pattern stops the watch.
+func (w *Watcher) AddGlob(pattern string, opts ...AddOption) error {
+	pattern = filepath.Clean(pattern)
+	if w.isClosed() {
+		return &WatchError{Op: "add", Path: pattern, Err: ErrClosed}
+	}
+	glob, err := parseGlob(pattern)
+	if err != nil {
+		return &WatchError{Op: "add", Path: pattern, Err: err}
+	}
+	with := getOptions(opts...)
+	if err := with.exclude.check(); err != nil {
+		return &WatchError{Op: "add", Path: pattern, Err: err}
+	}
+	if with.exclude.git != nil {
+		with.exclude.git.init(glob.root)
+	}
+
+	w.mu.Lock()
+	g := w.globs[pattern]
+	if g == nil {
+		g = &globWatch{pattern: pattern, glob: glob, dirs: make(map[string]bool)}
+		w.globs[pattern] = g
+	}
+	old := g.with.exclude
+	g.with.ops |= with.ops
+	g.with.exclude = with.exclude
+	w.watchIgnores(with.exclude)
+	w.mu.Unlock()
+
+	_, err = w.addGlobDirs(g, glob.root, false, time.Time{})
+	w.mu.Lock()
+	if err != nil && len(g.dirs) == 0 {
+		delete(w.globs, pattern)
+	}
+	w.releaseIgnores(old)
+	w.releaseIgnores(with.exclude)
+	w.mu.Unlock()
+	return err
+}
+
+// globWatch is a pattern watched with AddGlob.
+type globWatch struct {
+	pattern string          // Pattern as given to AddGlob
+	glob    globPattern     // Pattern, split up
+	with    watchOptions    // Options the pattern was added with
+	dirs    map[string]bool // Directories watched for the pattern
+}
+
+// globMask is what the watches on the directories of a pattern ask for on
+// top of the operations of the pattern, to learn about new directories.
+const globMask = unix.IN_CREATE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// matches returns the operations g reports for path. Must be called with
+// w.mu held.
+func (g *globWatch) matches(path string, isDir bool) Op {
+	if !g.glob.match(path) || g.with.exclude.excludes(g.glob.root, path, isDir) {
+		return 0
+	}
+	return g.with.ops
+}
+
+// addGlobDirs watches dir and the directories below it that can contain a
+// match for g, in the same way addTree does for trees. If scan is set it also
+// returns Create events, stamped with now, for the matches below dir.
+func (w *Watcher) addGlobDirs(g *globWatch, dir string, scan bool, now time.Time) ([]Event, error) {
+	w.mu.Lock()
+	with := g.with
+	w.mu.Unlock()
+	mask := opsToMask(with.ops) | globMask
+
+	var events []Event
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return &WatchError{Op: "add", Path: path, Err: err}
+		}
+		if path != g.glob.root && with.exclude.excludes(g.glob.root, path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if scan && path != dir && with.ops&Create == Create && g.glob.match(path) {
+			events = append(events, Event{Name: path, Op: Create, IsDir: d.IsDir(), Time: now})
+		}
+		if !d.IsDir() {
+			if path == dir {
+				return &WatchError{Op: "add", Path: path, Err: unix.ENOTDIR}
+			}
+			return nil
+		}
+		if !g.glob.canMatchBelow(path) {
+			return filepath.SkipDir
+		}
+
+		w.mu.Lock()
+		if w.globs[g.pattern] != g {
+			// Removed in the meantime.
+			w.mu.Unlock()
+			return filepath.SkipDir
+		}
+		err = w.addInternal(path, mask)
+		if err == nil {
+			g.dirs[path] = true
+		}
+		w.mu.Unlock()
+		if err != nil {
+			if path != dir && errors.Is(err, unix.ENOENT) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		return nil
+	})
+	return events, err
+}
+
+// dropGlobDirs stops watching the directories of g below dir, or those that
+// can't contain a match anymore if stale is set. Must be called with w.mu
+// held.
+func (w *Watcher) dropGlobDirs(g *globWatch, dir string, stale bool) {
+	for path := range g.dirs {
+		if !inTree(dir, path) || (stale && g.glob.canMatchBelow(path)) {
+			continue
+		}
+		delete(g.dirs, path)
+		w.releaseInternal(path)
+	}
+}
+
+// unwatchGlob stops watching g. Must be called with w.mu held.
+func (w *Watcher) unwatchGlob(g *globWatch) {
+	delete(w.globs, g.pattern)
+	for dir := range g.dirs {
+		w.releaseInternal(dir)
+	}
+	w.releaseIgnores(g.with.exclude)
+}
+
+// ignoreMask is what watches leaving out what git ignores ask for on top of
+// their operations, to learn about changes to the ignore files.
+const ignoreMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// watchIgnores watches the directories holding ignore files that apply to
+// a watch if x leaves out what git ignores, but that it doesn't watch
+// itself: those above the watched path, and the one holding the exclude
+// file, which is in the git directory that is always left out. Must be
+// called with w.mu held.
+func (w *Watcher) watchIgnores(x exclusion) {
+	if x.git == nil {
+		return
+	}
+	for _, dir := range x.git.dirs() {
+		// A git directory without info has no exclude file to follow.
+		_ = w.addInternal(dir, ignoreMask)
+	}
+}
+
+// releaseIgnores stops watching the directories watchIgnores watched for x,
+// unless another watch needs them. Must be called with w.mu held.
+func (w *Watcher) releaseIgnores(x exclusion) {
+	if x.git == nil {
+		return
+	}
+	for _, dir := range x.git.dirs() {
+		w.releaseInternal(dir)
+	}
+}
+
+// needsIgnoreDir reports whether a watch leaves out what git ignores with
+// an ignore file in dir that watchIgnores watches. Must be called with w.mu
+// held.
+func (w *Watcher) needsIgnoreDir(dir string) bool {
+	uses := func(x exclusion) bool {
+		if x.git == nil {
+			return false
+		}
+		for _, d := range x.git.dirs() {
+			if d == dir {
+				return true
+			}
+		}
+		return false
+	}
+	for _, watch := range w.watches {
+		if !watch.internal && uses(watch.exclude) {
+			return true
+		}
+	}
+	for _, t := range w.recursive {
+		if uses(t.with.exclude) {
+			return true
+		}
+	}
+	for _, p := range w.pending {
+		if uses(p.with.exclude) {
+			return true
+		}
+	}
+	for _, g := range w.globs {
+		if uses(g.with.exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadIgnores reads the ignore file path again for the watches leaving out
+// what git ignores, then stops watching the directories of trees and
+// patterns that are ignored now and walks them again for those that no
+// longer are. It returns false if the Watcher was closed while sending.
+func (w *Watcher) reloadIgnores(path string, now time.Time) bool {
+	w.mu.Lock()
+	gits := make(map[*gitignore]bool)
+	for _, watch := range w.watches {
+		if git := watch.exclude.git; git != nil && !gits[git] && git.owns(path) {
+			gits[git] = true
+		}
+	}
+	for _, t := range w.recursive {
+		if git := t.with.exclude.git; git != nil && !gits[git] && git.owns(path) {
+			gits[git] = true
+		}
+	}
+	for _, g := range w.globs {
+		if git := g.with.exclude.git; git != nil && !gits[git] && git.owns(path) {
+			gits[git] = true
+		}
+	}
+	for git := range gits {
+		git.forget(path)
+	}
+
+	var (
+		trees []*tree
+		globs []*globWatch
+	)
+	for _, t := range w.recursive {
+		if gits[t.with.exclude.git] {
+			trees = append(trees, t)
+		}
+	}
+	for _, g := range w.globs {
+		if gits[g.with.exclude.git] {
+			globs = append(globs, g)
+			for dir := range g.dirs {
+				if dir != g.glob.root && g.with.exclude.git.ignored(dir, true) {
+					delete(g.dirs, dir)
+					w.releaseInternal(dir)
+				}
+			}
+		}
+	}
+	for dir, watch := range w.watches {
+		t := watch.tree
+		if t == nil || !gits[t.with.exclude.git] || dir == t.root || !t.with.exclude.git.ignored(dir, true) {
+			continue
+		}
+		w.dropWatch(int(watch.wd), dir)
+		w.endWatch(int(watch.wd), dir, watch.ops, UnwatchRemoved)
+		if success, _ := unix.InotifyRmWatch(w.fd, watch.wd); success == -1 {
+			delete(w.ending, int(watch.wd))
+		}
+	}
+	w.mu.Unlock()
+
+	for _, t := range trees {
+		if !w.watchTree(t, t.root, false, now) {
+			return false
+		}
+	}
+	for _, g := range globs {
+		if !w.watchGlob(g, g.glob.root, false, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// unwatchFile stops watching f. Must be called with w.mu held.
+func (w *Watcher) unwatchFile(f *fileWatch) {
+	delete(w.files, f.name)
+	for dir := range f.dirs {
+		w.releaseInternal(dir)
+	}
+}
+
+// fileWatch is a file watched with WatchFile.
+type fileWatch struct {
+	name  string          // Path the file was watched by
+	paths map[string]bool // Every link on the way to the file, and the file, or the first path found missing
+	dirs  map[string]bool // Directories containing paths, which are watched
+	id    fileID          // What the file was when last looked at
+}
+
+// fileID tells apart versions of a file.
+type fileID struct {
+	exists bool
+	dev    uint64
+	ino    uint64
+	size   int64
+	mtime  unix.Timespec
+}
+
+// fileMask is what the watches on the directories on the way to a file
+// watched with WatchFile ask for. IN_MODIFY is left out so that a file
+// written in place is reported once, when it is closed.
+const fileMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_CLOSE_WRITE | unix.IN_ONLYDIR
+
+// maxLinks is how many symbolic links resolveLinks follows, like the kernel.
+const maxLinks = 40
+
+// resolveLinks follows the symbolic links on the way to name. It returns the
+// path of every link it went through, and then the file it led to, or the
+// first path that doesn't exist.
+func resolveLinks(name string) ([]string, error) {
+	var paths []string
+	links := 0
+	dir, rest := "", name
+	if filepath.IsAbs(name) {
+		dir, rest = string(filepath.Separator), name[1:]
+	}
+	for rest != "" {
+		var elem string
+		if i := strings.IndexRune(rest, filepath.Separator); i >= 0 {
+			elem, rest = rest[:i], rest[i+1:]
+		} else {
+			elem, rest = rest, ""
+		}
+		path := filepath.Join(dir, elem)
+		if elem == "" || elem == "." || elem == ".." {
+			dir = path
+			continue
+		}
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, unix.ENOTDIR) {
+				return append(paths, path), nil
+			}
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			dir = path
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return nil, &os.PathError{Op: "readlink", Path: name, Err: unix.ELOOP}
+		}
+		dest, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if filepath.IsAbs(dest) {
+			dir, dest = string(filepath.Separator), dest[1:]
+		}
+		if rest == "" {
+			rest = dest
+		} else {
+			rest = dest + string(filepath.Separator) + rest
+		}
+	}
+	return append(paths, dir), nil
+}
+
+// follow looks up the file f leads to, moves the watches on the way to it,
+// and returns the operation for how the file changed since it was last
+// looked at, if at all. Must be called with w.mu held.
+func (w *Watcher) follow(f *fileWatch) (Op, error) {
+	for {
+		paths, err := resolveLinks(f.name)
+		if err != nil {
+			return 0, &WatchError{Op: "add", Path: f.name, Err: err}
+		}
+		dirs := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			dirs[filepath.Dir(path)] = true
+		}
+
+		old := f.dirs
+		f.paths, f.dirs = make(map[string]bool, len(paths)), dirs
+		for _, path := range paths {
+			f.paths[path] = true
+		}
+		var armErr error
+		for dir := range dirs {
+			if err := w.addInternal(dir, fileMask); err != nil && armErr == nil {
+				armErr = err
+			}
+		}
+		for dir := range old {
+			if !dirs[dir] {
+				w.releaseInternal(dir)
+			}
+		}
+		if armErr != nil && !errors.Is(armErr, unix.ENOENT) && !errors.Is(armErr, unix.ENOTDIR) {
+			return 0, armErr
+		}
+
+		// Look again now that the directories are watched, in case a link
+		// changed before they were.
+		again, err := resolveLinks(f.name)
+		if err != nil {
+			return 0, &WatchError{Op: "add", Path: f.name, Err: err}
+		}
+		if armErr != nil || len(again) != len(paths) {
+			continue
+		}
+		stable := true
+		for _, path := range again {
+			stable = stable && f.paths[path]
+		}
+		if !stable {
+			continue
+		}
+
+		var id fileID
+		var st unix.Stat_t
+		if err := unix.Stat(f.name, &st); err == nil {
+			id = fileID{exists: true, dev: uint64(st.Dev), ino: uint64(st.Ino), size: st.Size, mtime: st.Mtim}
+		}
+		prev := f.id
+		f.id = id
+		switch {
+		case id == prev:
+			return 0, nil
+		case !prev.exists:
+			return Create, nil
+		case !id.exists:
+			return Remove, nil
+		default:
+			return Write, nil
+		}
+	}
+}
+
+// followFiles looks up the files watched by files again, and sends an event for
+// each that changed, stamped with now. It returns false if the Watcher was
+// closed while sending.
+func (w *Watcher) followFiles(files []*fileWatch, now time.Time) bool {
+	var (
+		events []Event
+		errs   []error
+	)
+	w.mu.Lock()
+	for _, f := range files {
+		if w.files[f.name] != f {
+			// Removed already.
+			continue
+		}
+		op, err := w.follow(f)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if op != 0 {
+			events = append(events, Event{Name: f.name, Op: op, Time: now})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, err := range errs {
+		select {
+		case w.Errors <- err:
+		case <-w.done:
+			return false
+		}
+	}
+	for _, event := range events {
+		if !w.sendEvent(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// resumePending resumes the pending watches in ps, and sends a Create event
+// for each path that now exists, stamped with now. It returns false if the
+// Watcher was closed while sending.
+func (w *Watcher) resumePending(ps []*pendingWatch, now time.Time) bool {
+	var (
+		events []Event
+		errs   []error
+	)
+	w.mu.Lock()
+	for _, p := range ps {
+		if w.pending[p.name] != p {
+			// Removed, or resumed already.
+			continue
+		}
+		armed, err := w.resume(p)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if armed && p.with.ops&Create == Create {
+			fi, err := os.Stat(p.name)
+			events = append(events, Event{Name: p.name, Op: Create, IsDir: err == nil && fi.IsDir(), Time: now})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, err := range errs {
+		select {
+		case w.Errors <- err:
+		case <-w.done:
+			return false
+		}
+	}
+	for _, event := range events {
+		if !w.sendEvent(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// addWatch adds or widens the inotify watch on name so it reports the
+// operations in with, asking the kernel for the extra flags as well. The
+// exclusions in with are left for the caller to set, as those of a tree
+// apply to the tree rather than to each of its watches. Must be called with
+// w.mu held.
+func (w *Watcher) addWatch(name string, with watchOptions, extra uint32) (*watch, error) {
+	flags := opsToMask(with.ops) | extra
+	if with.exclude.git != nil {
+		flags |= ignoreMask
+	}
+	if flags == 0 {
+		// inotify refuses an empty mask, such as for a watch that only
+		// wants Unwatch, so ask for something rare that gets filtered out.
+		flags = unix.IN_DELETE_SELF
+	}
+
 	watchEntry := w.watches[name]
 	if watchEntry != nil {
 		flags |= watchEntry.flags | unix.IN_MASK_ADD
+	} else if w.budget > 0 && len(w.watches) >= w.budget {
+		return nil, &WatchError{Op: "add", Path: name, Err: fmt.Errorf("%w: budget of %d watches used up", ErrWatchLimitReached, w.budget)}
 	}
 	wd, errno := unix.InotifyAddWatch(w.fd, name, flags)
 	if wd == -1 {
-		return errno
+		if errno == unix.ENOSPC {
+			// Not a full disk, despite what the errno says.
+			errno = &watchLimitError{max: maxUserWatches()}
+		}
+		return nil, &WatchError{Op: "add", Path: name, Err: errno}
+	}
+
+	if watchEntry == nil {
+		watchEntry = &watch{wd: uint32(wd), flags: flags, ops: with.ops}
+		w.watches[name] = watchEntry
+		w.paths[wd] = name
+	} else {
+		watchEntry.wd = uint32(wd)
+		watchEntry.flags = flags
+		watchEntry.ops |= with.ops
+		watchEntry.internal = false
+	}
+	// The kernel doesn't set IN_ISDIR on the events of the watch itself,
+	// such as IN_DELETE_SELF.
+	if fi, err := os.Stat(name); err == nil {
+		watchEntry.isDir = fi.IsDir()
+	}
+
+	// Take the listing only once the watch is armed, so that nothing
+	// created in between is missed.
+	if with.resync {
+		if listing, err := readListing(name); err == nil {
+			watchEntry.listing = listing
+		}
+	}
+
+	return watchEntry, nil
+}
+
+// AddRecursive starts watching the named directory and every directory
+// below it, with the same options as AddWith. Directories created or moved
+// into the tree later are watched as well; each is read after its watch is
+// armed, and Create events are sent for what it already contains, so files
+// created before the watch was in place aren't missed. A file created in
+// that window may be reported twice.
+//
+// Symbolic links to directories are not followed.
+func (w *Watcher) AddRecursive(name string, opts ...AddOption) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return &WatchError{Op: "add", Path: name, Err: ErrClosed}
+	}
+
+	with := getOptions(opts...)
+	if err := with.exclude.check(); err != nil {
+		return &WatchError{Op: "add", Path: name, Err: err}
+	}
+	if with.exclude.git != nil {
+		with.exclude.git.init(name)
+	}
+
+	w.mu.Lock()
+	t := w.recursive[name]
+	if t == nil {
+		t = &tree{root: name}
+		w.recursive[name] = t
+	}
+	old := t.with.exclude
+	t.pruned = nil
+	t.with.ops |= with.ops
+	t.with.resync = t.with.resync || with.resync
+	t.with.exclude = with.exclude
+	t.with.maxDepth = with.maxDepth
+	t.with.maxDirs = with.maxDirs
+	w.watchIgnores(with.exclude)
+	w.mu.Unlock()
+
+	_, err := w.addTree(t, name, false, time.Time{})
+	w.mu.Lock()
+	if _, ok := w.watches[name]; err != nil && !ok {
+		delete(w.recursive, name)
+	}
+	w.releaseIgnores(old)
+	w.releaseIgnores(with.exclude)
+	w.mu.Unlock()
+	return err
+}
+
+// treeMask is what the watch of every directory in a tree asks for on top of
+// the operations of the tree, to learn about new subdirectories.
+const treeMask = unix.IN_CREATE | unix.IN_MOVED_TO
+
+// addTree watches dir and the directories below it as part of t. Each
+// directory is watched before it is read, so nothing created in it can slip
+// by. If scan is set it also returns Create events, stamped with now, for
+// everything below dir, which is new to the tree. Directories left out
+// because a limit was reached are reported with a *LimitError.
+func (w *Watcher) addTree(t *tree, dir string, scan bool, now time.Time) ([]Event, error) {
+	w.mu.Lock()
+	root, with := t.root, t.with
+	w.mu.Unlock()
+
+	var (
+		events   []Event
+		skipped  []string
+		limitErr error
+	)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != dir && errors.Is(err, fs.ErrNotExist) {
+				// Removed while walking; its removal is reported as usual.
+				return nil
+			}
+			return &WatchError{Op: "add", Path: path, Err: err}
+		}
+		if path != dir && with.exclude.excludes(root, path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if scan && path != dir && with.ops&Create == Create {
+			events = append(events, Event{Name: path, Op: Create, IsDir: d.IsDir(), Time: now})
+		}
+		if !d.IsDir() && path != dir {
+			return nil
+		}
+		if with.maxDepth >= 0 && depth(root, path) > with.maxDepth {
+			return filepath.SkipDir
+		}
+
+		w.mu.Lock()
+		if t.removed || t.prunes(path) {
+			w.mu.Unlock()
+			return filepath.SkipDir
+		}
+		watch := w.watches[path]
+		if with.maxDirs > 0 && t.dirs >= with.maxDirs && path != root && (watch == nil || watch.tree != t) {
+			err = fmt.Errorf("%w: tree limit of %d directories", ErrWatchLimitReached, with.maxDirs)
+		} else {
+			watch, err = w.addWatch(path, with, treeMask)
+		}
+		if err == nil && watch.tree != t {
+			if watch.tree != nil {
+				watch.tree.dirs--
+			}
+			watch.tree = t
+			t.dirs++
+		}
+		w.mu.Unlock()
+
+		switch {
+		case err == nil:
+			return nil
+		case path != dir && errors.Is(err, unix.ENOENT):
+			return filepath.SkipDir
+		case path != root && errors.Is(err, ErrWatchLimitReached):
+			skipped = append(skipped, path)
+			if limitErr == nil {
+				limitErr = err
+				var watchErr *WatchError
+				if errors.As(err, &watchErr) {
+					limitErr = watchErr.Err
+				}
+			}
+			return filepath.SkipDir
+		default:
+			return err
+		}
+	})
+	if err == nil && len(skipped) > 0 {
+		err = &WatchError{Op: "add", Path: dir, Err: &LimitError{Skipped: skipped, Err: limitErr}}
+	}
+	return events, err
+}
+
+// depth returns how many levels path is below root.
+func depth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// watchLimitError is the error for inotify_add_watch failing with ENOSPC,
+// which means the user has run out of inotify watches.
+type watchLimitError struct {
+	max string // Value of fs.inotify.max_user_watches, if known.
+}
+
+func (e *watchLimitError) Error() string {
+	if e.max == "" {
+		return ErrWatchLimitReached.Error()
+	}
+	return fmt.Sprintf("%s (fs.inotify.max_user_watches is %s)", ErrWatchLimitReached, e.max)
+}
+
+func (e *watchLimitError) Is(target error) bool {
+	return target == ErrWatchLimitReached
+}
+
+func (e *watchLimitError) Unwrap() error {
+	return unix.ENOSPC
+}
+
+// maxUserWatches returns the current inotify watch limit, or "" if it
+// can't be read.
+func maxUserWatches() string {
+	max, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(max))
+}
+
+// opsToMask returns the inotify mask needed to report ops. Adding the same
+// path again with other ops widens the watch with IN_MASK_ADD, and events
+// are filtered against the union of the ops asked for.
+func opsToMask(ops Op) uint32 {
+	var mask uint32
+	if ops&Create == Create {
+		// IN_MOVED_FROM is needed to tell a file moved in from a rename
+		// within the directory.
+		mask |= unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM
+	}
+	if ops&Write == Write {
+		mask |= unix.IN_MODIFY
+	}
+	if ops&Remove == Remove {
+		mask |= unix.IN_DELETE | unix.IN_DELETE_SELF
+	}
+	if ops&Rename == Rename {
+		// IN_MOVED_TO is needed to pair up the halves of a rename.
+		mask |= unix.IN_MOVE_SELF | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	}
+	if ops&Chmod == Chmod {
+		mask |= unix.IN_ATTRIB
+	}
+	if ops&Open == Open {
+		mask |= unix.IN_OPEN
+	}
+	if ops&Access == Access {
+		mask |= unix.IN_ACCESS
+	}
+	if ops&CloseWrite == CloseWrite {
+		mask |= unix.IN_CLOSE_WRITE
+	}
+	if ops&CloseNoWrite == CloseNoWrite {
+		mask |= unix.IN_CLOSE_NOWRITE
+	}
+	return mask
+}
+
+// Remove stops watching the named file or directory (non-recursively).
+func (w *Watcher) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	// Fetch the watch.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.pending[name]; ok {
+		delete(w.pending, name)
+		w.releaseAnchor(p)
+		w.releaseIgnores(p.with.exclude)
+		return nil
+	}
+	if f, ok := w.files[name]; ok {
+		w.unwatchFile(f)
+		return nil
+	}
+	if g, ok := w.globs[name]; ok {
+		w.unwatchGlob(g)
+		return nil
+	}
+	watch, ok := w.watches[name]
+
+	// Remove it from inotify.
+	if !ok || watch.internal {
+		return &WatchError{Op: "remove", Path: name, Err: ErrNonExistentWatch}
+	}
+	if exclude := watch.exclude; w.keepInternal(name, watch, UnwatchRemoved) {
+		w.releaseIgnores(exclude)
+		return nil
+	}
+
+	// We successfully removed the watch if InotifyRmWatch doesn't return an
+	// error, we need to clean up our internal state to ensure it matches
+	// inotify's kernel state.
+	w.dropWatch(int(watch.wd), name)
+	w.endWatch(int(watch.wd), name, watch.ops, UnwatchRemoved)
+	w.releaseIgnores(watch.exclude)
+
+	// inotify_rm_watch will return EINVAL if the file has been deleted;
+	// the inotify will already have been removed.
+	// watches and pathes are deleted in ignoreLinux() implicitly and asynchronously
+	// by calling inotify_rm_watch() below. e.g. readEvents() goroutine receives IN_IGNORE
+	// so that EINVAL means that the wd is being rm_watch()ed or its file removed
+	// by another thread and we have not received IN_IGNORE event.
+	success, errno := unix.InotifyRmWatch(w.fd, watch.wd)
+	if success == -1 {
+		// TODO: Perhaps it's not helpful to return an error here in every case.
+		// the only two possible errors are:
+		// EBADF, which happens when w.fd is not a valid file descriptor of any kind.
+		// EINVAL, which is when fd is not an inotify descriptor or wd is not a valid watch descriptor.
+		// Watch descriptors are invalidated when they are removed explicitly or implicitly;
+		// explicitly by inotify_rm_watch, implicitly when the file they are watching is deleted.
+		delete(w.ending, int(watch.wd))
+		return &WatchError{Op: "remove", Path: name, Err: errno}
+	}
+
+	return nil
+}
+
+// RemoveRecursive stops watching name and every file and directory below
+// it, however they were added, and stops AddRecursive from watching
+// directories created there from now on, even if name is inside a tree that
+// is still watched, until AddRecursive is called for that tree again. All
+// watches are removed at once, so none are picked up while it runs. Watches
+// the kernel has already dropped, such as for directories deleted in the
+// meantime, are skipped.
+func (w *Watcher) RemoveRecursive(name string) error {
+	name = filepath.Clean(name)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var (
+		found    bool
+		firstErr error
+		released []exclusion // Exclusions whose .git/info watch may be unneeded now
+	)
+	for root, t := range w.recursive {
+		switch {
+		case inTree(name, root):
+			t.removed = true
+			delete(w.recursive, root)
+			released = append(released, t.with.exclude)
+		case inTree(root, name):
+			if t.pruned == nil {
+				t.pruned = make(map[string]bool)
+			}
+			t.pruned[name] = true
+		}
+	}
+	for path, p := range w.pending {
+		if inTree(name, path) {
+			found = true
+			delete(w.pending, path)
+			w.releaseAnchor(p)
+			released = append(released, p.with.exclude)
+		}
+	}
+	for path, f := range w.files {
+		if inTree(name, path) {
+			found = true
+			w.unwatchFile(f)
+		}
+	}
+	for _, g := range w.globs {
+		if inTree(name, g.glob.root) {
+			found = true
+			w.unwatchGlob(g)
+		}
+	}
+	for path, watch := range w.watches {
+		if !inTree(name, path) || watch.internal {
+			continue
+		}
+		found = true
+		if watch.exclude.git != nil {
+			released = append(released, watch.exclude)
+		}
+		if w.keepInternal(path, watch, UnwatchRemoved) {
+			continue
+		}
+		w.dropWatch(int(watch.wd), path)
+		w.endWatch(int(watch.wd), path, watch.ops, UnwatchRemoved)
+
+		success, errno := unix.InotifyRmWatch(w.fd, watch.wd)
+		if success == -1 {
+			delete(w.ending, int(watch.wd))
+			// EINVAL means the kernel got there first, and the IN_IGNORED
+			// saying so is still on its way.
+			if errno != unix.EINVAL && firstErr == nil {
+				firstErr = &WatchError{Op: "remove", Path: path, Err: errno}
+			}
+		}
+	}
+	for _, x := range released {
+		w.releaseIgnores(x)
+	}
+	if !found {
+		return &WatchError{Op: "remove", Path: name, Err: ErrNonExistentWatch}
+	}
+	return firstErr
+}
+
+// WatchList returns the directories and files that are being monitered,
+// including those added WithPending that don't exist right now.
+func (w *Watcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entries := make([]string, 0, len(w.watches))
+	for pathname, watch := range w.watches {
+		if !watch.internal {
+			entries = append(entries, pathname)
+		}
+	}
+	for pathname := range w.pending {
+		// Until its IN_IGNORED is read, a deleted path is both.
+		if watch := w.watches[pathname]; watch == nil || watch.internal {
+			entries = append(entries, pathname)
+		}
+	}
+	for pathname := range w.files {
+		entries = append(entries, pathname)
+	}
+	for pattern := range w.globs {
+		entries = append(entries, pattern)
 	}
 
-	if watchEntry == nil {
-		w.watches[name] = &watch{wd: uint32(wd), flags: flags}
-		w.paths[wd] = name
-	} else {
-		watchEntry.wd = uint32(wd)
-		watchEntry.flags = flags
-	}
+	return entries
+}
 
-	return nil
+// InotifyEvent holds the raw inotify event an Event was made from. It is
+// returned by Event.Sys on Linux; for a paired rename it is the IN_MOVED_TO
+// half.
+type InotifyEvent struct {
+	Wd     int32  // Watch descriptor the event was reported for.
+	Mask   uint32 // Mask of inotify(7) flags describing the event.
+	Cookie uint32 // Cookie connecting the halves of a rename.
+	Name   string // Name of the file relative to the watched directory, if any.
 }
 
-// Remove stops watching the named file or directory (non-recursively).
-func (w *Watcher) Remove(name string) error {
-	name = filepath.Clean(name)
+type watch struct {
+	wd       uint32               // Watch descriptor (as returned by the inotify_add_watch() syscall)
+	flags    uint32               // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	listing  map[string]fileState // Last known directory listing, for watches added WithResync
+	ops      Op                   // Operations asked for with WithOps
+	tree     *tree                // Tree this directory was watched for by AddRecursive, if any
+	exclude  exclusion            // Entries to leave out, from WithExclude and WithExcludeFunc
+	pending  *pendingWatch        // Watch added WithPending, resumed if the path is deleted
+	internal bool                 // Only watched as the anchor of pending watches
+	isDir    bool                 // The watched path is a directory
+	renamed  bool                 // Path already rewritten by renameWatches for the next IN_MOVE_SELF
+	paired   bool                 // renameWatches was for a rename reported as a whole
+}
 
-	// Fetch the watch.
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	watch, ok := w.watches[name]
+// tree is a directory watched with AddRecursive.
+type tree struct {
+	root    string          // Directory AddRecursive was called with
+	with    watchOptions    // Options every directory in the tree is watched with
+	removed bool            // Set by RemoveRecursive to stop adding directories
+	pruned  map[string]bool // Directories inside the tree removed with RemoveRecursive
+	dirs    int             // Number of directories watched for the tree
+}
 
-	// Remove it from inotify.
-	if !ok {
-		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+// prunes reports whether path is in a part of t removed with
+// RemoveRecursive. Must be called with w.mu held.
+func (t *tree) prunes(path string) bool {
+	for dir := range t.pruned {
+		if inTree(dir, path) {
+			return true
+		}
 	}
+	return false
+}
 
-	// We successfully removed the watch if InotifyRmWatch doesn't return an
-	// error, we need to clean up our internal state to ensure it matches
-	// inotify's kernel state.
-	delete(w.paths, int(watch.wd))
+// ending is a watch that has been removed but whose IN_IGNORED hasn't been
+// read yet.
+type ending struct {
+	name   string
+	reason UnwatchReason
+}
+
+// dropWatch forgets the watch wd on name, which the kernel no longer has or
+// is about to drop. Must be called with w.mu held.
+func (w *Watcher) dropWatch(wd int, name string) {
+	delete(w.paths, wd)
+	watch := w.watches[name]
+	if watch == nil || watch.wd != uint32(wd) {
+		// The path has been watched again since.
+		return
+	}
 	delete(w.watches, name)
+	if watch.tree != nil {
+		watch.tree.dirs--
+	}
+}
 
-	// inotify_rm_watch will return EINVAL if the file has been deleted;
-	// the inotify will already have been removed.
-	// watches and pathes are deleted in ignoreLinux() implicitly and asynchronously
-	// by calling inotify_rm_watch() below. e.g. readEvents() goroutine receives IN_IGNORE
-	// so that EINVAL means that the wd is being rm_watch()ed or its file removed
-	// by another thread and we have not received IN_IGNORE event.
-	success, errno := unix.InotifyRmWatch(w.fd, watch.wd)
-	if success == -1 {
-		// TODO: Perhaps it's not helpful to return an error here in every case.
-		// the only two possible errors are:
-		// EBADF, which happens when w.fd is not a valid file descriptor of any kind.
-		// EINVAL, which is when fd is not an inotify descriptor or wd is not a valid watch descriptor.
-		// Watch descriptors are invalidated when they are removed explicitly or implicitly;
-		// explicitly by inotify_rm_watch, implicitly when the file they are watching is deleted.
-		return errno
+// endWatch remembers that the watch wd on name is going away for reason, so
+// an Unwatch event can be sent once the kernel confirms it with IN_IGNORED.
+// Must be called with w.mu held.
+func (w *Watcher) endWatch(wd int, name string, ops Op, reason UnwatchReason) {
+	if ops&Unwatch == Unwatch {
+		w.ending[wd] = ending{name: name, reason: reason}
 	}
+}
 
-	return nil
+// fileState is what resync compares to notice a change to a file.
+type fileState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
 }
 
-// WatchList returns the directories and files that are being monitered.
-func (w *Watcher) WatchList() []string {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+func newFileState(fi os.FileInfo) fileState {
+	return fileState{isDir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime()}
+}
 
-	entries := make([]string, 0, len(w.watches))
-	for pathname := range w.watches {
-		entries = append(entries, pathname)
+// readListing returns the state of every entry in the directory name.
+func readListing(name string) (map[string]fileState, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
 	}
-
-	return entries
+	listing := make(map[string]fileState, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			// Removed since ReadDir.
+			continue
+		}
+		listing[entry.Name()] = newFileState(fi)
+	}
+	return listing, nil
 }
 
-type watch struct {
-	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
-	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+// moveTimeout is how long readEvents waits for the IN_MOVED_TO half of a
+// rename after reading an IN_MOVED_FROM it can't pair yet. The kernel queues
+// both halves together, so they are only split across reads when the first
+// one fills the buffer.
+var moveTimeout = 10 * time.Millisecond
+
+// pendingMove is an IN_MOVED_FROM event waiting for its IN_MOVED_TO partner.
+type pendingMove struct {
+	cookie uint32
+	event  Event
+	hidden bool // The file was moved from a path that isn't reported on.
 }
 
 // readEvents reads from the inotify file descriptor, converts the
 // received events into Event objects and sends them via the Events channel
 func (w *Watcher) readEvents() {
 	var (
-		buf   [unix.SizeofInotifyEvent * 4096]byte // Buffer for a maximum of 4096 raw events
-		errno error                                // Syscall errno
+		buf          = make([]byte, w.readBuffer) // Buffer for raw events, 4096 of them by default
+		errno        error                        // Syscall errno
+		moved        *pendingMove                 // Rename waiting for its second half
+		moveDeadline time.Time                    // When to give up waiting for it
 	)
 
 	defer close(w.doneResp)
 	defer close(w.Errors)
+	defer close(w.Batches)
 	defer close(w.Events)
 
 	for {
@@ -199,19 +1444,58 @@ func (w *Watcher) readEvents() {
 			return
 		}
 
+		// Send what the last read brought, and the Unwatch events of
+		// watches kept for internal use, before waiting for more.
+		if !w.sendKept() || !w.sendBatch() {
+			return
+		}
+
+		// The deadline is set with w.mu held so keepInternal can't be
+		// missed between sendKept and here.
+		w.mu.Lock()
+		var deadline time.Time
+		switch {
+		case len(w.kept) > 0:
+			deadline = time.Now()
+		case moved != nil:
+			// Only wait a short while for the second half of a rename.
+			if moveDeadline.IsZero() {
+				moveDeadline = time.Now().Add(moveTimeout)
+			}
+			deadline = moveDeadline
+		}
+		_ = w.inotifyFile.SetReadDeadline(deadline)
+		w.mu.Unlock()
+
 		n, err := w.inotifyFile.Read(buf[:])
 		switch {
 		case errors.Unwrap(err) == os.ErrClosed:
 			return
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if moved == nil || time.Now().Before(moveDeadline) {
+				// Woken up by keepInternal.
+				continue
+			}
+			// No IN_MOVED_TO arrived, so the file was moved out of the
+			// watched tree.
+			w.movedOut(moved.event)
+			if !moved.hidden && !w.sendEvent(moved.event) {
+				return
+			}
+			moved, moveDeadline = nil, time.Time{}
+			continue
 		case err != nil:
 			select {
-			case w.Errors <- err:
+			case w.Errors <- &WatchError{Op: "read", Err: err}:
 			case <-w.done:
 				return
 			}
 			continue
 		}
 
+		now := time.Now()
+		moveDeadline = time.Time{}
+
 		if n < unix.SizeofInotifyEvent {
 			var err error
 			if n == 0 {
@@ -225,7 +1509,7 @@ func (w *Watcher) readEvents() {
 				err = errors.New("notify: short read in readEvents()")
 			}
 			select {
-			case w.Errors <- err:
+			case w.Errors <- &WatchError{Op: "read", Err: err}:
 			case <-w.done:
 				return
 			}
@@ -256,51 +1540,614 @@ func (w *Watcher) readEvents() {
 			// the "paths" map.
 			w.mu.Lock()
 			name, ok := w.paths[int(raw.Wd)]
-			// IN_DELETE_SELF occurs when the file/directory being watched is removed.
+			var (
+				ops         Op
+				t           *tree
+				exclude     exclusion // Relative to the watched directory
+				treeExclude exclusion // Relative to the root of its tree
+				isDir       bool
+			)
+			if watch := w.watches[name]; ok && watch != nil {
+				ops, t, exclude, isDir = watch.ops, watch.tree, watch.exclude, watch.isDir
+				if t != nil {
+					treeExclude = t.with.exclude
+				}
+			}
+			// A watch moves itself with IN_MOVE_SELF. A rename read from
+			// its parent already changed its path, and reported the move
+			// if it was paired; otherwise its path no longer leads to it.
+			var repeated, stale bool
+			if watch := w.watches[name]; ok && watch != nil && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+				repeated, stale = watch.paired, !watch.renamed
+				watch.renamed, watch.paired = false, false
+			}
+			dir, root := name, name
+			if t != nil {
+				root = t.root
+			}
+			// IN_DELETE_SELF occurs when the file/directory being watched is removed,
+			// and IN_UNMOUNT when the filesystem it is on is unmounted. IN_IGNORED
+			// without either means the watch went away for some other reason.
 			// This is a sign to clean up the maps, otherwise we are no longer in sync
 			// with the inotify kernel state which has already deleted the watch
 			// automatically.
-			if ok && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
-				delete(w.paths, int(raw.Wd))
-				delete(w.watches, name)
+			var (
+				resumed  []*pendingWatch
+				followed []*fileWatch
+			)
+			if ok && mask&(unix.IN_DELETE_SELF|unix.IN_UNMOUNT|unix.IN_IGNORED) != 0 {
+				// Watches added WithPending go back to waiting, both for
+				// their own path and for the ancestor they waited on.
+				if watch := w.watches[name]; watch != nil && watch.wd == uint32(raw.Wd) && watch.pending != nil {
+					resumed = append(resumed, watch.pending)
+					w.pending[name] = watch.pending
+				}
+				for _, p := range w.pending {
+					if p.anchor == name {
+						p.anchor = ""
+						resumed = append(resumed, p)
+					}
+				}
+				for _, f := range w.files {
+					if f.dirs[name] {
+						followed = append(followed, f)
+					}
+				}
+				if watch := w.watches[name]; watch != nil && watch.wd == uint32(raw.Wd) {
+					for _, g := range w.globs {
+						delete(g.dirs, name)
+					}
+				}
+				w.dropWatch(int(raw.Wd), name)
+				reason := UnwatchDeleted
+				if mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
+					reason = UnwatchUnmounted
+				}
+				w.endWatch(int(raw.Wd), name, ops, reason)
+			}
+			end, ended := w.ending[int(raw.Wd)]
+			if ended && mask&unix.IN_IGNORED == unix.IN_IGNORED {
+				delete(w.ending, int(raw.Wd))
+			} else {
+				ended = false
 			}
 			w.mu.Unlock()
 
+			sys := &InotifyEvent{Wd: raw.Wd, Mask: mask, Cookie: raw.Cookie}
 			if nameLen > 0 {
 				// Point "bytes" at the first byte of the filename
 				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
 				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
-				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+				sys.Name = strings.TrimRight(string(bytes[0:nameLen]), "\000")
+				name += "/" + sys.Name
 			}
 
 			event := newEvent(name, mask)
+			if nameLen == 0 {
+				event.IsDir = isDir
+			}
+			event.sys = sys
+			event.Time = now
+			excluded := false
+			if nameLen > 0 {
+				excluded = (!exclude.empty() && exclude.excludes(dir, name, event.IsDir)) ||
+					(!treeExclude.empty() && treeExclude.excludes(root, name, event.IsDir))
+			}
+			allowed := ops
+			if excluded {
+				allowed = 0
+			}
+			var globs []*globWatch // Patterns watching the directory
+			if nameLen > 0 {
+				w.mu.Lock()
+				for _, g := range w.globs {
+					if g.dirs[filepath.Dir(name)] {
+						globs = append(globs, g)
+						allowed |= g.matches(name, event.IsDir)
+					}
+				}
+				w.mu.Unlock()
+			}
+			if ok {
+				// Only report what the watches asked for; a single inotify
+				// flag can stand for more than one Op and vice versa.
+				event.Op &= allowed
+			} else {
+				// Left over from a watch that was removed already.
+				event.Op &= Overflow
+			}
+			if t != nil && nameLen == 0 && name != t.root {
+				// The parent directory reports what happens to the
+				// directories inside a tree.
+				event.Op &= Unmount
+			}
+			if repeated {
+				event.Op &^= Rename
+			}
+			// Whether the event is for a path the user doesn't hear about,
+			// as far as pairing renames is concerned.
+			hidden := event.Op == 0
+			if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && allowed&(Create|Rename) != 0 {
+				hidden = false
+			}
 
-			// Send the events that are not ignored on the events channel
-			if !event.ignoreLinux(mask) {
-				select {
-				case w.Events <- event:
-				case <-w.done:
+			renamed := false
+			var renamedFrom string // Old path of a file moved within the watches
+			if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && moved != nil && raw.Cookie == moved.cookie {
+				renamedFrom = moved.event.Name
+			}
+			// A pending IN_MOVED_FROM that isn't immediately followed by its
+			// IN_MOVED_TO was moved out of the watched tree.
+			if moved != nil && (mask&unix.IN_MOVED_TO == 0 || raw.Cookie != moved.cookie) {
+				w.movedOut(moved.event)
+				if !moved.hidden && !w.sendEvent(moved.event) {
+					return
+				}
+				moved = nil
+			}
+
+			switch {
+			case mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM:
+				// Hold on to the first half of a rename until we know
+				// where it went.
+				event.move = moveOut
+				moved = &pendingMove{cookie: raw.Cookie, event: event, hidden: hidden}
+			case mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && moved != nil && !moved.hidden && hidden:
+				// Moved to a path that isn't reported on, which is as good
+				// as out of the watched tree.
+				w.movedOut(moved.event)
+				if !w.sendEvent(moved.event) {
+					return
+				}
+				moved = nil
+			case mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && moved != nil && !moved.hidden:
+				// Both halves of a rename within the watched tree: the
+				// old path is renamed away as usual, and the new one is
+				// created knowing where it came from.
+				old := moved.event
+				old.move = moveNone
+				moved = nil
+				renamed = true
+				if !w.sendEvent(old) {
+					return
+				}
+				event.OldName = old.Name
+				if !event.ignoreLinux(mask) && !w.sendEvent(event) {
+					return
+				}
+			default:
+				if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+					// Moved in from elsewhere, unless it was from a path
+					// that isn't reported on, which makes it merely
+					// created.
+					if renamedFrom == "" {
+						event.move = moveIn
+					}
+					moved = nil
+				}
+				// Send the events that are not ignored on the events channel
+				if !event.ignoreLinux(mask) {
+					if !w.sendEvent(event) {
+						return
+					}
+				}
+			}
+
+			if renamedFrom != "" {
+				w.renameWatches(renamedFrom, name, renamed)
+			}
+
+			if stale {
+				w.mu.Lock()
+				w.dropMoved(name)
+				w.mu.Unlock()
+			}
+
+			if mask&unix.IN_ISDIR == unix.IN_ISDIR && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				// A new directory that may contain matches.
+				for _, g := range globs {
+					if !w.watchGlob(g, name, !renamed, now) {
+						return
+					}
+				}
+			}
+
+			if t != nil && !excluded && mask&unix.IN_ISDIR == unix.IN_ISDIR && mask&treeMask != 0 {
+				// A new directory in a tree; what a rename brings along
+				// was already there, so only announce what a creation or
+				// move from elsewhere does.
+				if !w.watchTree(t, name, !renamed, now) {
+					return
+				}
+			}
+
+			if nameLen > 0 && (sys.Name == ".gitignore" || sys.Name == "exclude") && mask&ignoreMask != 0 {
+				// An ignore file changed for watches leaving out what
+				// git ignores.
+				if !w.reloadIgnores(name, now) {
+					return
+				}
+			}
+
+			if ended {
+				unwatch := Event{Name: end.name, Op: Unwatch, reason: end.reason, Time: now, sys: sys}
+				if !w.sendEvent(unwatch) {
 					return
 				}
 			}
 
+			if mask&(unix.IN_CREATE|unix.IN_MOVED_TO|unix.IN_Q_OVERFLOW) != 0 {
+				// The next directory down, or the path itself, may have
+				// appeared for pending watches waiting here.
+				w.mu.Lock()
+				for _, p := range w.pending {
+					if mask&unix.IN_Q_OVERFLOW != 0 || (nameLen > 0 && p.anchor == filepath.Dir(name) && inTree(name, p.name)) {
+						resumed = append(resumed, p)
+					}
+				}
+				w.mu.Unlock()
+			}
+			if len(resumed) > 0 && !w.resumePending(resumed, now) {
+				return
+			}
+			if nameLen > 0 || mask&unix.IN_Q_OVERFLOW != 0 {
+				// Something on the way to a file watched with WatchFile
+				// may have changed.
+				w.mu.Lock()
+				for _, f := range w.files {
+					if mask&unix.IN_Q_OVERFLOW != 0 || f.paths[name] {
+						followed = append(followed, f)
+					}
+				}
+				w.mu.Unlock()
+			}
+			if len(followed) > 0 && !w.followFiles(followed, now) {
+				return
+			}
+
+			if mask&unix.IN_Q_OVERFLOW == unix.IN_Q_OVERFLOW {
+				if !w.resync(now) {
+					return
+				}
+				// Directories created in trees may have been lost too.
+				w.mu.Lock()
+				trees := make([]*tree, 0, len(w.recursive))
+				for _, t := range w.recursive {
+					trees = append(trees, t)
+				}
+				w.mu.Unlock()
+				for _, t := range trees {
+					if !w.watchTree(t, t.root, false, now) {
+						return
+					}
+				}
+				w.mu.Lock()
+				globs := make([]*globWatch, 0, len(w.globs))
+				for _, g := range w.globs {
+					globs = append(globs, g)
+				}
+				w.mu.Unlock()
+				for _, g := range globs {
+					if !w.watchGlob(g, g.glob.root, false, now) {
+						return
+					}
+				}
+			} else if nameLen > 0 {
+				w.updateListing(raw.Wd, sys.Name, name)
+			}
+
 			// Move to the next event in the buffer
 			offset += unix.SizeofInotifyEvent + nameLen
 		}
 	}
 }
 
+// watchTree adds the directory dir that appeared in t, and sends the Create
+// events found by addTree if scan is set. It returns false if the Watcher was
+// closed while sending.
+func (w *Watcher) watchTree(t *tree, dir string, scan bool, now time.Time) bool {
+	events, err := w.addTree(t, dir, scan, now)
+	return w.sendFound(events, err)
+}
+
+// watchGlob is watchTree for the directory dir that appeared in g.
+func (w *Watcher) watchGlob(g *globWatch, dir string, scan bool, now time.Time) bool {
+	events, err := w.addGlobDirs(g, dir, scan, now)
+	return w.sendFound(events, err)
+}
+
+// sendFound sends what was found by walking a new directory: err, unless
+// the directory is gone already, and the events. It returns false if the
+// Watcher was closed while sending.
+func (w *Watcher) sendFound(events []Event, err error) bool {
+	if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, fs.ErrNotExist) {
+		select {
+		case w.Errors <- err:
+		case <-w.done:
+			return false
+		}
+	}
+	for _, event := range events {
+		if !w.sendEvent(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// renameWatches moves the watches on oldName and everything below it to
+// newName, which inotify keeps watching under the same descriptors, so that
+// their events are reported with the new path. paired is whether the rename
+// was reported as a whole, which the IN_MOVE_SELF of oldName would repeat.
+func (w *Watcher) renameWatches(oldName, newName string, paired bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Only look through every watch for directories, which can contain
+	// other watches.
+	watch, ok := w.watches[oldName]
+	if !ok {
+		return
+	}
+	if watch.flags&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+		watch.renamed, watch.paired = true, paired
+	}
+
+	var moved []string
+	for path := range w.watches {
+		if inTree(oldName, path) {
+			moved = append(moved, path)
+		}
+	}
+	for _, path := range moved {
+		watch := w.watches[path]
+		path2 := newName + path[len(oldName):]
+		delete(w.watches, path)
+		w.watches[path2] = watch
+		w.paths[int(watch.wd)] = path2
+	}
+	for root, t := range w.recursive {
+		if inTree(oldName, root) {
+			delete(w.recursive, root)
+			t.root = newName + root[len(oldName):]
+			w.recursive[t.root] = t
+		}
+		var pruned []string
+		for dir := range t.pruned {
+			if inTree(oldName, dir) {
+				pruned = append(pruned, dir)
+			}
+		}
+		for _, dir := range pruned {
+			delete(t.pruned, dir)
+			t.pruned[newName+dir[len(oldName):]] = true
+		}
+	}
+	for _, g := range w.globs {
+		var dirs []string
+		for dir := range g.dirs {
+			if inTree(oldName, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+		for _, dir := range dirs {
+			delete(g.dirs, dir)
+			g.dirs[newName+dir[len(oldName):]] = true
+		}
+		w.dropGlobDirs(g, newName, true)
+	}
+}
+
+// movedOut stops watching the directories of trees and patterns below the
+// directory moved out of the watched tree by e, as they aren't part of it
+// anymore.
+func (w *Watcher) movedOut(e Event) {
+	if !e.IsDir {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, g := range w.globs {
+		w.dropGlobDirs(g, e.Name, false)
+	}
+	for path, watch := range w.watches {
+		if watch.tree == nil || path == watch.tree.root || !inTree(e.Name, path) {
+			continue
+		}
+		w.dropWatch(int(watch.wd), path)
+		w.endWatch(int(watch.wd), path, watch.ops, UnwatchRemoved)
+		if success, _ := unix.InotifyRmWatch(w.fd, watch.wd); success == -1 {
+			delete(w.ending, int(watch.wd))
+		}
+	}
+}
+
+// dropMoved stops watching name, whose watch was moved without a rename the
+// Watcher could follow, so that events aren't reported under a path that no
+// longer leads to it. Watches that trees, pending watches, WatchFile,
+// patterns or ignore files rely on are kept as they are. Must be called with
+// w.mu held.
+func (w *Watcher) dropMoved(name string) {
+	watch := w.watches[name]
+	if watch == nil || watch.internal || watch.tree != nil || watch.pending != nil || w.needsInternal(name, watch) {
+		return
+	}
+	w.dropWatch(int(watch.wd), name)
+	w.endWatch(int(watch.wd), name, watch.ops, UnwatchMoved)
+	w.releaseIgnores(watch.exclude)
+	if success, _ := unix.InotifyRmWatch(w.fd, watch.wd); success == -1 {
+		delete(w.ending, int(watch.wd))
+	}
+}
+
+// sendKept sends the Unwatch events keepInternal left for readEvents. It
+// returns false if the Watcher was closed while sending.
+func (w *Watcher) sendKept() bool {
+	w.mu.Lock()
+	kept := w.kept
+	w.kept = nil
+	w.mu.Unlock()
+	for _, e := range kept {
+		if !w.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendEvent sends e on the Events channel, or holds it back for the next
+// batch with WithBatches, numbering it with the next sequence number. It
+// returns false if the Watcher was closed before the event could be
+// delivered.
+func (w *Watcher) sendEvent(e Event) bool {
+	w.seq++
+	e.Seq = w.seq
+	if w.batching {
+		w.batch = append(w.batch, e)
+		return true
+	}
+	select {
+	case w.Events <- e:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendBatch sends the events held back by sendEvent with WithBatches on the
+// Batches channel. It returns false if the Watcher was closed before the
+// batch could be delivered.
+func (w *Watcher) sendBatch() bool {
+	if len(w.batch) == 0 {
+		return true
+	}
+	batch := w.batch
+	w.batch = nil
+	select {
+	case w.Batches <- batch:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// updateListing keeps the listing of a watch added WithResync in step with
+// the events read for the entry base of its directory, found at path.
+func (w *Watcher) updateListing(wd int32, base, path string) {
+	w.mu.Lock()
+	watch := w.watches[w.paths[int(wd)]]
+	w.mu.Unlock()
+	if watch == nil || watch.listing == nil {
+		return
+	}
+
+	fi, err := os.Lstat(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if watch.listing == nil {
+		return
+	}
+	if err != nil {
+		delete(watch.listing, base)
+	} else {
+		watch.listing[base] = newFileState(fi)
+	}
+}
+
+// resync re-reads the directories watched WithResync after an overflow, and
+// sends Create, Remove and Write events for whatever changed since their last
+// known listing. It returns false if the Watcher was closed while sending.
+func (w *Watcher) resync(now time.Time) bool {
+	w.mu.Lock()
+	var dirs []string
+	for name, watch := range w.watches {
+		if watch.listing != nil {
+			dirs = append(dirs, name)
+		}
+	}
+	w.mu.Unlock()
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		listing, err := readListing(dir)
+		if err != nil {
+			// The directory is gone; its removal will be reported by
+			// IN_DELETE_SELF, if that wasn't lost as well.
+			listing = map[string]fileState{}
+		}
+
+		w.mu.Lock()
+		watch := w.watches[dir]
+		if watch == nil || watch.listing == nil {
+			w.mu.Unlock()
+			continue
+		}
+		old := watch.listing
+		watch.listing = listing
+		ops, exclude := watch.ops, watch.exclude
+		var (
+			root        string
+			treeExclude exclusion
+		)
+		if watch.tree != nil {
+			root, treeExclude = watch.tree.root, watch.tree.with.exclude
+		}
+		w.mu.Unlock()
+
+		var events []Event
+		for base, st := range old {
+			if _, ok := listing[base]; !ok {
+				events = append(events, Event{Name: filepath.Join(dir, base), Op: Remove, IsDir: st.isDir})
+			}
+		}
+		for base, st := range listing {
+			prev, ok := old[base]
+			switch {
+			case !ok || prev.isDir != st.isDir:
+				events = append(events, Event{Name: filepath.Join(dir, base), Op: Create, IsDir: st.isDir})
+			case !st.isDir && (prev.size != st.size || !prev.modTime.Equal(st.modTime)):
+				events = append(events, Event{Name: filepath.Join(dir, base), Op: Write})
+			}
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+
+		for _, event := range events {
+			// Only report what the watch asked for and doesn't leave
+			// out, as for the events read from the kernel.
+			event.Op &= ops
+			if event.Op == 0 ||
+				(!exclude.empty() && exclude.excludes(dir, event.Name, event.IsDir)) ||
+				(!treeExclude.empty() && treeExclude.excludes(root, event.Name, event.IsDir)) {
+				continue
+			}
+			event.Time = now
+			if !w.sendEvent(event) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Certain types of events can be "ignored" and not sent over the Events
 // channel. Such as events marked ignore by the kernel, or MODIFY events
 // against files that do not exist.
 func (e *Event) ignoreLinux(mask uint32) bool {
-	// Ignore anything the inotify API says to ignore
-	return mask&unix.IN_IGNORED == unix.IN_IGNORED
+	// Ignore anything the inotify API says to ignore; Unwatch is sent
+	// separately.
+	if mask&unix.IN_IGNORED == unix.IN_IGNORED {
+		return true
+	}
+	// Ignore events the watch didn't ask for, such as unmounts, which the
+	// kernel always reports.
+	return e.Op == 0
 }
 
 // newEvent returns an platform-independent Event based on an inotify mask.
 func newEvent(name string, mask uint32) Event {
-	e := Event{Name: name}
+	e := Event{Name: name, IsDir: mask&unix.IN_ISDIR == unix.IN_ISDIR}
 	if mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
 		e.Op |= Create
 	}
@@ -316,5 +2163,23 @@ func newEvent(name string, mask uint32) Event {
 	if mask&unix.IN_ATTRIB == unix.IN_ATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&unix.IN_OPEN == unix.IN_OPEN {
+		e.Op |= Open
+	}
+	if mask&unix.IN_ACCESS == unix.IN_ACCESS {
+		e.Op |= Access
+	}
+	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
+		e.Op |= CloseWrite
+	}
+	if mask&unix.IN_CLOSE_NOWRITE == unix.IN_CLOSE_NOWRITE {
+		e.Op |= CloseNoWrite
+	}
+	if mask&unix.IN_Q_OVERFLOW == unix.IN_Q_OVERFLOW {
+		e.Op |= Overflow
+	}
+	if mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
+		e.Op |= Unmount
+	}
 	return e
 }
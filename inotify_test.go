@@ -10,14 +10,18 @@ package fsnotify
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestInotifyCloseRightAway(t *testing.T) {
@@ -542,3 +546,1469 @@ func TestINotifyNoBlockingSyscalls(t *testing.T) {
 		t.Fatalf("Got a nonzero diff %v. starting: %v. ending: %v", diff, startingThreads, endingThreads)
 	}
 }
+
+// nextEvent waits for the next event from w, failing the test on an error or
+// if none arrives within timeout.
+func nextEvent(t *testing.T, w *Watcher, timeout time.Duration) Event {
+	t.Helper()
+	select {
+	case ev := <-w.Events:
+		return ev
+	case err := <-w.Errors:
+		t.Fatalf("Error from watcher: %v", err)
+	case <-time.After(timeout):
+		t.Fatalf("Took too long to wait for event")
+	}
+	return Event{}
+}
+
+// expectEvent waits for the next event from w and checks that it has the
+// Name, Op and OldName of want.
+func expectEvent(t *testing.T, w *Watcher, want Event) {
+	t.Helper()
+	if ev := nextEvent(t, w, time.Second); ev.Name != want.Name || ev.Op != want.Op || ev.OldName != want.OldName {
+		t.Fatalf("Expected %v, got %v", want, ev)
+	}
+}
+
+func TestInotifyRenamePairing(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	outsideDir := tempMkdir(t)
+	defer os.RemoveAll(outsideDir)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	testFile := filepath.Join(testDir, "testfile")
+	renamedFile := filepath.Join(testDir, "renamed")
+	outsideFile := filepath.Join(outsideDir, "outside")
+	if err := ioutil.WriteFile(testFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to create testFile: %v", err)
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Rename within the watched directory.
+	if err := os.Rename(testFile, renamedFile); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Op != Rename || ev.Name != testFile || ev.OldName != "" || ev.MovedOut() {
+		t.Fatalf("Expected %s to be renamed within the directory, got %v", testFile, ev)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Op != Create || ev.Name != renamedFile || ev.OldName != testFile || ev.MovedIn() {
+		t.Fatalf("Expected %s to be created from %s, got %v", renamedFile, testFile, ev)
+	}
+
+	// Move out of the watched directory.
+	if err := os.Rename(renamedFile, outsideFile); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Op != Rename || ev.Name != renamedFile || ev.OldName != "" || !ev.MovedOut() {
+		t.Fatalf("Expected %s to be moved out, got %v", renamedFile, ev)
+	}
+
+	// Move back in from outside.
+	if err := os.Rename(outsideFile, testFile); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Op != Create || ev.Name != testFile || !ev.MovedIn() {
+		t.Fatalf("Expected %s to be moved in, got %v", testFile, ev)
+	}
+
+	// A watch only for Create still sees where a rename came from.
+	created, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer created.Close()
+	if err := created.AddWith(testDir, WithOps(Create)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if err := os.Rename(testFile, renamedFile); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	if ev := nextEvent(t, created, time.Second); ev.Op != Create || ev.Name != renamedFile || ev.OldName != "" || ev.MovedIn() {
+		t.Fatalf("Expected %s to be created, got %v", renamedFile, ev)
+	}
+}
+
+func TestInotifyIsDir(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	testSubdir := filepath.Join(testDir, "subdir")
+	testFile := filepath.Join(testDir, "testfile")
+	if err := os.Mkdir(testSubdir, 0o755); err != nil {
+		t.Fatalf("Failed to create subdir: %v", err)
+	}
+	if err := ioutil.WriteFile(testFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create testFile: %v", err)
+	}
+	if err := os.Remove(testSubdir); err != nil {
+		t.Fatalf("Failed to remove subdir: %v", err)
+	}
+
+	for _, want := range []Event{
+		{Name: testSubdir, Op: Create, IsDir: true},
+		{Name: testFile, Op: Create},
+		{Name: testSubdir, Op: Remove, IsDir: true},
+	} {
+		if ev := nextEvent(t, w, time.Second); ev.Name != want.Name || ev.Op != want.Op || ev.IsDir != want.IsDir {
+			t.Fatalf("Expected %v (dir %t), got %v (dir %t)", want, want.IsDir, ev, ev.IsDir)
+		}
+	}
+
+	// The kernel doesn't set IN_ISDIR on the events of a watched directory
+	// itself.
+	otherDir := tempMkdir(t)
+	defer os.RemoveAll(otherDir)
+	if err := w.Add(otherDir); err != nil {
+		t.Fatalf("Failed to add otherDir: %v", err)
+	}
+	if err := os.Remove(otherDir); err != nil {
+		t.Fatalf("Failed to remove otherDir: %v", err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Name != otherDir || ev.Op != Remove || !ev.IsDir {
+		t.Fatalf("Expected %q: REMOVE (dir true), got %v (dir %t)", otherDir, ev, ev.IsDir)
+	}
+}
+
+func TestInotifyCloseWrite(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "testfile")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testDir, WithOps(CloseWrite)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(testFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to write testFile: %v", err)
+	}
+
+	if ev := nextEvent(t, w, time.Second); ev.Name != testFile || ev.Op != CloseWrite {
+		t.Fatalf("Expected CLOSE_WRITE on %s, got %v", testFile, ev)
+	}
+}
+
+func TestInotifyEventSys(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "testfile")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if err := ioutil.WriteFile(testFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create testFile: %v", err)
+	}
+
+	ev := nextEvent(t, w, time.Second)
+	sys, ok := ev.Sys().(*InotifyEvent)
+	if !ok {
+		t.Fatalf("Expected Sys to return *InotifyEvent, got %T", ev.Sys())
+	}
+	if sys.Mask != unix.IN_CREATE || sys.Name != "testfile" || sys.Wd != int32(w.watches[testDir].wd) {
+		t.Fatalf("Unexpected raw event %+v", sys)
+	}
+}
+
+func TestInotifySeqAndTime(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(filepath.Join(testDir, strconv.Itoa(i)), nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	for want := uint64(1); want <= 3; want++ {
+		ev := nextEvent(t, w, time.Second)
+		if ev.Seq != want {
+			t.Fatalf("Expected sequence number %d, got %d for %v", want, ev.Seq, ev)
+		}
+		if ev.Time.Before(start) || ev.Time.After(time.Now()) {
+			t.Fatalf("Unexpected receive time %v for %v", ev.Time, ev)
+		}
+	}
+}
+
+func TestInotifyOverflowResync(t *testing.T) {
+	// Create more files than fit in the fs.inotify.max_queued_events
+	// default before reading any events, so that the queue overflows.
+	numDirs := 16
+	numFiles := 1200
+
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	for dn := 0; dn < numDirs; dn++ {
+		testSubdir := fmt.Sprintf("%s/%d", testDir, dn)
+		if err := os.Mkdir(testSubdir, 0o777); err != nil {
+			t.Fatalf("Cannot create subdir: %v", err)
+		}
+		if err := w.AddWith(testSubdir, WithResync()); err != nil {
+			t.Fatalf("Failed to add subdir: %v", err)
+		}
+	}
+
+	// Block the reader until every file exists.
+	w.mu.Lock()
+	for dn := 0; dn < numDirs; dn++ {
+		for fn := 0; fn < numFiles; fn++ {
+			if err := ioutil.WriteFile(fmt.Sprintf("%s/%d/%d", testDir, dn, fn), nil, 0o644); err != nil {
+				w.mu.Unlock()
+				t.Fatalf("Create failed: %v", err)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	created := make(map[string]bool)
+	overflows := 0
+	after := time.After(10 * time.Second)
+	for len(created) < numDirs*numFiles {
+		select {
+		case <-after:
+			t.Fatalf("Only got %d of %d creates", len(created), numDirs*numFiles)
+		case err := <-w.Errors:
+			if err != ErrEventOverflow {
+				t.Fatalf("Got an error from watcher: %v", err)
+			}
+		case evt := <-w.Events:
+			switch evt.Op {
+			case Create:
+				if created[evt.Name] {
+					t.Fatalf("Got a second create for %s", evt.Name)
+				}
+				created[evt.Name] = true
+			case Overflow:
+				overflows++
+			default:
+				t.Fatalf("Unexpected event %v", evt)
+			}
+		}
+	}
+
+	if overflows == 0 {
+		t.Fatalf("Could not trigger overflow")
+	}
+}
+
+func TestInotifyResyncFilter(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	for _, name := range []string{"kept", "new", "new.swp"} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), nil, 0o644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testDir, WithOps(Create), WithExclude("*.swp"), WithResync()); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Make the listing out of date as a lost event would, with one entry
+	// that is gone and two that are new.
+	w.mu.Lock()
+	watch := w.watches[testDir]
+	watch.listing["gone"] = watch.listing["kept"]
+	delete(watch.listing, "new")
+	delete(watch.listing, "new.swp")
+	w.mu.Unlock()
+
+	done := make(chan bool)
+	go func() { done <- w.resync(time.Now()) }()
+
+	var got []Event
+	for {
+		select {
+		case ev := <-w.Events:
+			got = append(got, ev)
+			continue
+		case err := <-w.Errors:
+			t.Fatalf("Error from watcher: %v", err)
+		case ok := <-done:
+			if !ok {
+				t.Fatalf("Watcher closed during resync")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to resync")
+		}
+		break
+	}
+
+	want := filepath.Join(testDir, "new")
+	if len(got) != 1 || got[0].Name != want || got[0].Op != Create {
+		t.Fatalf("Expected only %q: CREATE, got %v", want, got)
+	}
+}
+
+func TestInotifyUnwatch(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	removedDir := filepath.Join(testDir, "removed")
+	deletedDir := filepath.Join(testDir, "deleted")
+	for _, dir := range []string{removedDir, deletedDir} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	for _, dir := range []string{removedDir, deletedDir} {
+		if err := w.AddWith(dir, WithOps(Remove|Unwatch)); err != nil {
+			t.Fatalf("Failed to add %s: %v", dir, err)
+		}
+	}
+
+	if err := w.Remove(removedDir); err != nil {
+		t.Fatalf("Failed to remove watch: %v", err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Name != removedDir || ev.Op != Unwatch || ev.UnwatchReason() != UnwatchRemoved {
+		t.Fatalf("Expected %s to be unwatched because it was removed, got %v (%v)", removedDir, ev, ev.UnwatchReason())
+	}
+
+	if err := os.Remove(deletedDir); err != nil {
+		t.Fatalf("Failed to delete %s: %v", deletedDir, err)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Name != deletedDir || ev.Op != Remove {
+		t.Fatalf("Expected %s to be deleted, got %v", deletedDir, ev)
+	}
+	if ev := nextEvent(t, w, time.Second); ev.Name != deletedDir || ev.Op != Unwatch || ev.UnwatchReason() != UnwatchDeleted {
+		t.Fatalf("Expected %s to be unwatched because it was deleted, got %v (%v)", deletedDir, ev, ev.UnwatchReason())
+	}
+
+	if list := w.WatchList(); len(list) != 0 {
+		t.Fatalf("Expected an empty watch list, got %v", list)
+	}
+}
+
+func TestInotifyUnmount(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	if err := unix.Mount("fsnotify", testDir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Cannot mount a tmpfs: %v", err)
+	}
+	mounted := true
+	defer func() {
+		if mounted {
+			_ = unix.Unmount(testDir, 0)
+		}
+	}()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testDir, WithOps(Create|Unmount|Unwatch)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if err := unix.Unmount(testDir, 0); err != nil {
+		t.Fatalf("Failed to unmount testDir: %v", err)
+	}
+	mounted = false
+
+	for _, want := range []Op{Unmount, Unwatch} {
+		ev := nextEvent(t, w, time.Second)
+		if ev.Name != testDir || ev.Op != want {
+			t.Fatalf("Expected %v on %s, got %v", want, testDir, ev)
+		}
+		if want == Unwatch && ev.UnwatchReason() != UnwatchUnmounted {
+			t.Fatalf("Expected the watch to end because of the unmount, got %v", ev.UnwatchReason())
+		}
+	}
+
+	if list := w.WatchList(); len(list) != 0 {
+		t.Fatalf("Expected an empty watch list, got %v", list)
+	}
+}
+
+func TestInotifyOpFilter(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "testfile")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testDir, WithOps(Create)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	w.mu.Lock()
+	flags := w.watches[testDir].flags
+	w.mu.Unlock()
+	if flags&(unix.IN_MODIFY|unix.IN_ATTRIB) != 0 {
+		t.Fatalf("Expected a Create filter to leave out IN_MODIFY and IN_ATTRIB, got %#x", flags)
+	}
+
+	// Neither the write nor the removal are reported.
+	if err := ioutil.WriteFile(testFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to write testFile: %v", err)
+	}
+	if err := os.Remove(testFile); err != nil {
+		t.Fatalf("Failed to remove testFile: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(testDir, "subdir"), 0o755); err != nil {
+		t.Fatalf("Failed to create subdir: %v", err)
+	}
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+	expectEvent(t, w, Event{Name: filepath.Join(testDir, "subdir"), Op: Create})
+
+	// Adding the path again widens the filter.
+	if err := w.AddWith(testDir, WithOps(Remove)); err != nil {
+		t.Fatalf("Failed to add testDir again: %v", err)
+	}
+	if err := ioutil.WriteFile(testFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to write testFile: %v", err)
+	}
+	if err := os.Remove(testFile); err != nil {
+		t.Fatalf("Failed to remove testFile: %v", err)
+	}
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+	expectEvent(t, w, Event{Name: testFile, Op: Remove})
+}
+
+func TestInotifyWatchErrors(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	missing := filepath.Join(testDir, "missing")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+
+	var werr *WatchError
+	err = w.Add(missing)
+	if !errors.As(err, &werr) || werr.Op != "add" || werr.Path != missing || !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("Expected an add error for %s wrapping ENOENT, got %#v", missing, err)
+	}
+
+	err = w.Remove(missing)
+	if !errors.As(err, &werr) || werr.Op != "remove" || werr.Path != missing || !errors.Is(err, ErrNonExistentWatch) {
+		t.Fatalf("Expected a remove error for %s wrapping ErrNonExistentWatch, got %#v", missing, err)
+	}
+
+	w.Close()
+	if err := w.Add(testDir); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestInotifyWatchLimitError(t *testing.T) {
+	err := error(&WatchError{Op: "add", Path: "/tmp", Err: &watchLimitError{max: "8192"}})
+	if !errors.Is(err, ErrWatchLimitReached) || !errors.Is(err, unix.ENOSPC) {
+		t.Fatalf("Expected the error to be both ErrWatchLimitReached and ENOSPC, got %v", err)
+	}
+	expected := "add /tmp: watch limit reached (fs.inotify.max_user_watches is 8192)"
+	if err.Error() != expected {
+		t.Fatalf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestInotifyAddRecursive(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testSubdir := filepath.Join(testDir, "a")
+	if err := os.Mkdir(testSubdir, 0o755); err != nil {
+		t.Fatalf("Failed to create subdir: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// Keep the reader from picking up the new directory until all of it
+	// exists, so its contents can only be found by reading it.
+	newDir := filepath.Join(testDir, "b")
+	nestedDir := filepath.Join(newDir, "c")
+	nestedFile := filepath.Join(nestedDir, "testfile")
+	w.mu.Lock()
+	if err := os.MkdirAll(nestedDir, 0o755); err != nil {
+		w.mu.Unlock()
+		t.Fatalf("Failed to create nested dir: %v", err)
+	}
+	if err := ioutil.WriteFile(nestedFile, nil, 0o644); err != nil {
+		w.mu.Unlock()
+		t.Fatalf("Failed to create nested file: %v", err)
+	}
+	w.mu.Unlock()
+
+	for _, want := range []Event{
+		{Name: newDir, Op: Create, IsDir: true},
+		{Name: nestedDir, Op: Create, IsDir: true},
+		{Name: nestedFile, Op: Create},
+	} {
+		if ev := nextEvent(t, w, time.Second); ev.Name != want.Name || ev.Op != want.Op || ev.IsDir != want.IsDir {
+			t.Fatalf("Expected %v (dir %t), got %v (dir %t)", want, want.IsDir, ev, ev.IsDir)
+		}
+	}
+
+	// Both the directory that was there and the one picked up later are
+	// watched.
+	for _, name := range []string{filepath.Join(testSubdir, "testfile"), filepath.Join(nestedDir, "other")} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		expectEvent(t, w, Event{Name: name, Op: Create})
+	}
+}
+
+func TestInotifyExclude(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	gitDir := filepath.Join(testDir, ".git")
+	buildDir := filepath.Join(testDir, "build")
+	for _, dir := range []string{filepath.Join(gitDir, "objects"), buildDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testDir, WithExclude("[")); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("Expected ErrBadPattern, got %v", err)
+	}
+
+	backup := func(path string, isDir bool) bool { return strings.HasSuffix(path, "~") }
+	if err := w.AddRecursive(testDir, WithExclude(".git", "build/*.o"), WithExcludeFunc(backup)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	for _, name := range w.WatchList() {
+		if strings.HasPrefix(name, gitDir) {
+			t.Fatalf("Excluded directory %q is watched", name)
+		}
+	}
+
+	testFile := filepath.Join(buildDir, "main")
+	for _, name := range []string{
+		filepath.Join(gitDir, "HEAD"),
+		filepath.Join(buildDir, "main.o"),
+		filepath.Join(testDir, "main.go~"),
+		testFile,
+	} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+
+	// Watching a directory of the tree again adds to what the tree leaves
+	// out there, rather than replacing it.
+	if err := w.AddWith(buildDir, WithExclude("*.log")); err != nil {
+		t.Fatalf("Failed to add buildDir: %v", err)
+	}
+	otherFile := filepath.Join(buildDir, "other")
+	for _, name := range []string{
+		filepath.Join(buildDir, "lib.o"),
+		filepath.Join(buildDir, "lib.o~"),
+		filepath.Join(buildDir, "build.log"),
+		otherFile,
+	} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	expectEvent(t, w, Event{Name: otherFile, Op: Create})
+}
+
+func TestInotifyRemoveRecursive(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testSubdir := filepath.Join(testDir, "a")
+	nestedDir := filepath.Join(testSubdir, "b")
+	goneDir := filepath.Join(nestedDir, "c")
+	if err := os.MkdirAll(goneDir, 0o755); err != nil {
+		t.Fatalf("Failed to create nested dir: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if err := w.RemoveRecursive(filepath.Join(testDir, "missing")); !errors.Is(err, ErrNonExistentWatch) {
+		t.Fatalf("Expected ErrNonExistentWatch, got %v", err)
+	}
+
+	// A directory deleted just before is skipped, whether or not its
+	// IN_IGNORED has been read yet.
+	if err := os.Remove(goneDir); err != nil {
+		t.Fatalf("Failed to remove dir: %v", err)
+	}
+	if err := w.RemoveRecursive(testSubdir); err != nil {
+		t.Fatalf("Failed to remove subdir: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 1 || list[0] != testDir {
+		t.Fatalf("Expected only %q to be watched, got %q", testDir, list)
+	}
+
+	// Creating it again doesn't bring it back into the tree, which is
+	// still watched.
+	if err := os.RemoveAll(testSubdir); err != nil {
+		t.Fatalf("Failed to remove subdir: %v", err)
+	}
+	if err := os.MkdirAll(nestedDir, 0o755); err != nil {
+		t.Fatalf("Failed to create nested dir: %v", err)
+	}
+	otherDir := filepath.Join(testDir, "other")
+	if err := os.Mkdir(otherDir, 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	for ev := nextEvent(t, w, time.Second); ev.Name != otherDir; ev = nextEvent(t, w, time.Second) {
+		if ev.Name != goneDir && ev.Name != testSubdir {
+			t.Fatalf("Unexpected event after RemoveRecursive: %v", ev)
+		}
+	}
+	// The reader has dealt with the subdirectory by the time it sends the
+	// event for the next one.
+	for _, name := range w.WatchList() {
+		if inTree(testSubdir, name) {
+			t.Fatalf("Expected %q to be left out, got %q", testSubdir, w.WatchList())
+		}
+	}
+
+	if err := w.RemoveRecursive(testDir); err != nil {
+		t.Fatalf("Failed to remove testDir: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 0 {
+		t.Fatalf("Expected no watches, got %q", list)
+	}
+	if err := os.Mkdir(filepath.Join(testDir, "new"), 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.Name != goneDir && ev.Name != testSubdir {
+				t.Fatalf("Unexpected event after RemoveRecursive: %v", ev)
+			}
+		case err := <-w.Errors:
+			t.Fatalf("Error from watcher: %v", err)
+		case <-timeout:
+			if list := w.WatchList(); len(list) != 0 {
+				t.Fatalf("Expected no watches, got %q", list)
+			}
+			return
+		}
+	}
+}
+
+func TestInotifyTreeLimits(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	for _, dir := range []string{"a/x", "b/x", "c/x"} {
+		if err := os.MkdirAll(filepath.Join(testDir, dir), 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	w, err := NewWatcherWithOptions(WithWatchBudget(3))
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddRecursive(testDir, WithMaxDepth(0)); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 1 {
+		t.Fatalf("Expected only %q to be watched, got %q", testDir, list)
+	}
+
+	// The budget runs out after a and a/x.
+	err = w.AddRecursive(testDir)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || !errors.Is(err, ErrWatchLimitReached) {
+		t.Fatalf("Expected a LimitError, got %v", err)
+	}
+	expected := []string{filepath.Join(testDir, "b"), filepath.Join(testDir, "c")}
+	if fmt.Sprint(limitErr.Skipped) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %q to be skipped, got %q", expected, limitErr.Skipped)
+	}
+	if list := w.WatchList(); len(list) != 3 {
+		t.Fatalf("Expected 3 watches, got %q", list)
+	}
+
+	// Directories created later are held to the same limits.
+	if err := w.RemoveRecursive(testDir); err != nil {
+		t.Fatalf("Failed to remove testDir: %v", err)
+	}
+	testSubdir := filepath.Join(testDir, "a", "x")
+	if err := w.AddRecursive(testSubdir, WithMaxDirs(1), WithOps(0)); err != nil {
+		t.Fatalf("Failed to add subdir: %v", err)
+	}
+	newDir := filepath.Join(testSubdir, "new")
+	if err := os.Mkdir(newDir, 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	for {
+		select {
+		case ev := <-w.Events:
+			t.Fatalf("Unexpected event: %v", ev)
+		case err := <-w.Errors:
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Expected a LimitError, got %v", err)
+			}
+			if len(limitErr.Skipped) != 1 || limitErr.Skipped[0] != newDir {
+				t.Fatalf("Expected %q to be skipped, got %q", newDir, limitErr.Skipped)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to wait for error")
+		}
+	}
+}
+
+func TestInotifyRenameWatchedDir(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	outsideDir := tempMkdir(t)
+	defer os.RemoveAll(outsideDir)
+	oldDir := filepath.Join(testDir, "old")
+	if err := os.MkdirAll(filepath.Join(oldDir, "sub"), 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	newDir := filepath.Join(testDir, "new")
+	if err := os.Rename(oldDir, newDir); err != nil {
+		t.Fatalf("Failed to rename dir: %v", err)
+	}
+	expectEvent(t, w, Event{Name: oldDir, Op: Rename})
+	expectEvent(t, w, Event{Name: newDir, Op: Create, OldName: oldDir})
+
+	// Events from inside the renamed directory carry the new path.
+	testFile := filepath.Join(newDir, "sub", "testfile")
+	if err := ioutil.WriteFile(testFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+
+	list := w.WatchList()
+	sort.Strings(list)
+	expected := []string{testDir, newDir, filepath.Join(newDir, "sub")}
+	if fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %q to be watched, got %q", expected, list)
+	}
+
+	// Directories moved out of the tree are no longer watched.
+	if err := os.Rename(newDir, filepath.Join(outsideDir, "moved")); err != nil {
+		t.Fatalf("Failed to rename dir: %v", err)
+	}
+	expectEvent(t, w, Event{Name: newDir, Op: Rename})
+	if list := w.WatchList(); len(list) != 1 || list[0] != testDir {
+		t.Fatalf("Expected only %q to be watched, got %q", testDir, list)
+	}
+}
+
+func TestInotifyRenameSelf(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	outsideDir := tempMkdir(t)
+	defer os.RemoveAll(outsideDir)
+	oldDir := filepath.Join(testDir, "sub")
+	if err := os.Mkdir(oldDir, 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	outsideFile := filepath.Join(outsideDir, "testfile")
+	if err := ioutil.WriteFile(outsideFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	for _, name := range []string{testDir, oldDir} {
+		if err := w.Add(name); err != nil {
+			t.Fatalf("Failed to add %s: %v", name, err)
+		}
+	}
+	if err := w.AddWith(outsideFile, WithOps(Rename|Unwatch)); err != nil {
+		t.Fatalf("Failed to add outsideFile: %v", err)
+	}
+
+	// The rename reported by the parent isn't repeated by the directory.
+	newDir := filepath.Join(testDir, "sub2")
+	if err := os.Rename(oldDir, newDir); err != nil {
+		t.Fatalf("Failed to rename dir: %v", err)
+	}
+	expectEvent(t, w, Event{Name: oldDir, Op: Rename})
+	expectEvent(t, w, Event{Name: newDir, Op: Create, OldName: oldDir})
+	testFile := filepath.Join(newDir, "testfile")
+	if err := ioutil.WriteFile(testFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+
+	// A file renamed where its new path can't be known stops being watched.
+	if err := os.Rename(outsideFile, outsideFile+".moved"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	expectEvent(t, w, Event{Name: outsideFile, Op: Rename})
+	if ev := nextEvent(t, w, time.Second); ev.Name != outsideFile || ev.Op != Unwatch || ev.UnwatchReason() != UnwatchMoved {
+		t.Fatalf("Expected %s to be unwatched because it was moved, got %v (%v)", outsideFile, ev, ev.UnwatchReason())
+	}
+	list := w.WatchList()
+	sort.Strings(list)
+	if expected := []string{testDir, newDir}; fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %q to be watched, got %q", expected, list)
+	}
+}
+
+func TestInotifyPending(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "a", "b", "testfile")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(testFile, WithPending()); err != nil {
+		t.Fatalf("Failed to add testFile: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 1 || list[0] != testFile {
+		t.Fatalf("Expected only %q to be watched, got %q", testFile, list)
+	}
+
+	// waitFor skips events until one for op arrives.
+	waitFor := func(op Op) {
+		t.Helper()
+		for {
+			ev := nextEvent(t, w, time.Second)
+			if ev.Name != testFile {
+				t.Fatalf("Unexpected event: %v", ev)
+			}
+			if ev.Op == op {
+				return
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(testFile), 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(testFile, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	waitFor(Create)
+	if list := w.WatchList(); len(list) != 1 || list[0] != testFile {
+		t.Fatalf("Expected only %q to be watched, got %q", testFile, list)
+	}
+
+	// Deleting it goes back to waiting, even for its directory.
+	if err := os.RemoveAll(filepath.Join(testDir, "a")); err != nil {
+		t.Fatalf("Failed to remove dir: %v", err)
+	}
+	waitFor(Remove)
+	if list := w.WatchList(); len(list) != 1 || list[0] != testFile {
+		t.Fatalf("Expected only %q to be watched, got %q", testFile, list)
+	}
+	if err := os.MkdirAll(filepath.Dir(testFile), 0o755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(testFile, []byte("data"), 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	waitFor(Create)
+
+	if err := w.Remove(testFile); err != nil {
+		t.Fatalf("Failed to remove testFile: %v", err)
+	}
+	if err := w.AddWith(testFile+".missing", WithPending()); err != nil {
+		t.Fatalf("Failed to add missing file: %v", err)
+	}
+	if err := w.Remove(testFile + ".missing"); err != nil {
+		t.Fatalf("Failed to remove missing file: %v", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.watches) != 0 || len(w.pending) != 0 {
+		t.Fatalf("Expected no watches, got %d and %d pending", len(w.watches), len(w.pending))
+	}
+}
+
+func TestInotifyWatchFile(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	// Lay out a ConfigMap volume: key -> ..data/key, ..data -> ..v1.
+	write := func(name, data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	for _, dir := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(testDir, dir), 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	write("..v1/key", "v1")
+	write("..v2/key", "v2")
+	if err := os.Symlink("..v1", filepath.Join(testDir, "..data")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	testFile := filepath.Join(testDir, "key")
+	if err := os.Symlink(filepath.Join("..data", "key"), testFile); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.WatchFile(testFile); err != nil {
+		t.Fatalf("Failed to watch testFile: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 1 || list[0] != testFile {
+		t.Fatalf("Expected only %q to be watched, got %q", testFile, list)
+	}
+
+	// expect waits for a single event with op, and no more.
+	expect := func(op Op) {
+		t.Helper()
+		if ev := nextEvent(t, w, time.Second); ev.Name != testFile || ev.Op != op {
+			t.Fatalf("Expected %q: %v, got %v", testFile, op, ev)
+		}
+		select {
+		case ev := <-w.Events:
+			t.Fatalf("Unexpected event: %v", ev)
+		case err := <-w.Errors:
+			t.Fatalf("Error from watcher: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Swap the ..data link the way the kubelet does.
+	if err := os.Symlink("..v2", filepath.Join(testDir, "..data_tmp")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	if err := os.Rename(filepath.Join(testDir, "..data_tmp"), filepath.Join(testDir, "..data")); err != nil {
+		t.Fatalf("Failed to swap link: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(testDir, "..v1")); err != nil {
+		t.Fatalf("Failed to remove dir: %v", err)
+	}
+	expect(Write)
+
+	// Replace the file the way editors do, then write it in place.
+	write("..v2/key.tmp", "v3")
+	if err := os.Rename(filepath.Join(testDir, "..v2", "key.tmp"), filepath.Join(testDir, "..v2", "key")); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	expect(Write)
+	write("..v2/key", "v4")
+	expect(Write)
+
+	if err := os.Remove(filepath.Join(testDir, "..v2", "key")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	expect(Remove)
+	if err := os.Symlink(filepath.Join(testDir, "..v2", "other"), filepath.Join(testDir, "..v2", "key")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	// Renamed into place, so that closing it after writing can't be
+	// reported as well.
+	write("..v2/other.tmp", "v5")
+	if err := os.Rename(filepath.Join(testDir, "..v2", "other.tmp"), filepath.Join(testDir, "..v2", "other")); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	expect(Create)
+
+	if err := w.Remove(testFile); err != nil {
+		t.Fatalf("Failed to remove testFile: %v", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.watches) != 0 || len(w.files) != 0 {
+		t.Fatalf("Expected no watches, got %d and %d files", len(w.watches), len(w.files))
+	}
+}
+
+func TestInotifyAddGlob(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	for _, dir := range []string{"logs", "src"} {
+		if err := os.Mkdir(filepath.Join(testDir, dir), 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddGlob(filepath.Join(testDir, "logs", "[")); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("Expected ErrBadPattern, got %v", err)
+	}
+	if err := w.AddGlob(filepath.Join(testDir, "logs", "*.log")); err != nil {
+		t.Fatalf("Failed to add glob: %v", err)
+	}
+	if err := w.AddGlob(filepath.Join(testDir, "src", "**", "*.go")); err != nil {
+		t.Fatalf("Failed to add glob: %v", err)
+	}
+
+	// Hold up the reader until the nested directories exist, so the file
+	// in them can only be found by reading them.
+	testFile := filepath.Join(testDir, "src", "a", "b", "main.go")
+	w.mu.Lock()
+	if err := os.MkdirAll(filepath.Dir(testFile), 0o755); err != nil {
+		w.mu.Unlock()
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	for _, name := range []string{testFile, filepath.Join(testDir, "src", "a", "b", "README")} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			w.mu.Unlock()
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	w.mu.Unlock()
+
+	logFile := filepath.Join(testDir, "logs", "app.log")
+	for _, name := range []string{filepath.Join(testDir, "logs", "app.txt"), logFile} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	for _, name := range []string{testFile, logFile} {
+		expectEvent(t, w, Event{Name: name, Op: Create})
+	}
+
+	if err := w.Remove(filepath.Join(testDir, "src", "**", "*.go")); err != nil {
+		t.Fatalf("Failed to remove glob: %v", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.watches) != 1 {
+		t.Fatalf("Expected only the logs directory to be watched, got %d watches", len(w.watches))
+	}
+}
+
+func TestInotifyRemoveKeepsInternal(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		watch func(w *Watcher, dir string) error // Needs dir watched for itself
+		touch func(dir string) error             // Changes what it watches
+		want  string                             // Path of the Create or Write that follows
+		op    Op
+	}{
+		{
+			name: "WatchFile",
+			watch: func(w *Watcher, dir string) error {
+				if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0o644); err != nil {
+					return err
+				}
+				return w.WatchFile(filepath.Join(dir, "file"))
+			},
+			touch: func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0o644)
+			},
+			want: "file",
+			op:   Write,
+		},
+		{
+			name: "AddGlob",
+			watch: func(w *Watcher, dir string) error {
+				return w.AddGlob(filepath.Join(dir, "*.log"))
+			},
+			touch: func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, "app.log"), nil, 0o644)
+			},
+			want: "app.log",
+			op:   Create,
+		},
+		{
+			name: "WithPending",
+			watch: func(w *Watcher, dir string) error {
+				return w.AddWith(filepath.Join(dir, "sub", "file"), WithPending())
+			},
+			touch: func(dir string) error {
+				if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(filepath.Join(dir, "sub", "file"), nil, 0o644)
+			},
+			want: filepath.Join("sub", "file"),
+			op:   Create,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testDir := tempMkdir(t)
+			defer os.RemoveAll(testDir)
+
+			w, err := NewWatcher()
+			if err != nil {
+				t.Fatalf("Failed to create watcher: %v", err)
+			}
+			defer w.Close()
+
+			if err := tt.watch(w, testDir); err != nil {
+				t.Fatalf("Failed to watch: %v", err)
+			}
+			if err := w.AddWith(testDir, WithOps(Create|Unwatch)); err != nil {
+				t.Fatalf("Failed to add testDir: %v", err)
+			}
+			if err := w.Remove(testDir); err != nil {
+				t.Fatalf("Failed to remove testDir: %v", err)
+			}
+			expectEvent(t, w, Event{Name: testDir, Op: Unwatch})
+			for _, name := range w.WatchList() {
+				if name == testDir {
+					t.Fatalf("Expected %q to be left out, got %q", testDir, w.WatchList())
+				}
+			}
+
+			// The directory is only watched for the others from now on.
+			if err := ioutil.WriteFile(filepath.Join(testDir, "other"), nil, 0o644); err != nil {
+				t.Fatalf("Failed to create file: %v", err)
+			}
+			if err := tt.touch(testDir); err != nil {
+				t.Fatalf("Failed to change watched path: %v", err)
+			}
+			expectEvent(t, w, Event{Name: filepath.Join(testDir, tt.want), Op: tt.op})
+		})
+	}
+}
+
+func TestInotifyGitignore(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	infoDir := filepath.Join(testDir, ".git", "info")
+	buildDir := filepath.Join(testDir, "build")
+	srcDir := filepath.Join(testDir, "src")
+	for _, dir := range []string{infoDir, buildDir, srcDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	excludeFile := filepath.Join(infoDir, "exclude")
+	ignoreFile := filepath.Join(testDir, ".gitignore")
+	writeFile := func(name, data string) {
+		if err := ioutil.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	writeFile(excludeFile, "secret.txt\n")
+	writeFile(ignoreFile, "build/\n*.log\n")
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddRecursive(testDir, WithGitignore()); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	watched := func(dir string) bool {
+		for _, name := range w.WatchList() {
+			if name == dir {
+				return true
+			}
+		}
+		return false
+	}
+	if list := w.WatchList(); len(list) != 2 || !watched(testDir) || !watched(srcDir) {
+		t.Fatalf("Expected %q and %q to be watched, got %q", testDir, srcDir, list)
+	}
+
+	// expect waits for an event for name, skipping those for the ignore file.
+	expect := func(name string) {
+		t.Helper()
+		ev := nextEvent(t, w, time.Second)
+		for ev.Name == ignoreFile {
+			ev = nextEvent(t, w, time.Second)
+		}
+		if ev.Name != name || ev.Op != Create {
+			t.Fatalf("Expected %q: CREATE, got %v", name, ev)
+		}
+	}
+	// waitWatched waits for the ignore file to be read again, which happens
+	// after its events are sent.
+	waitWatched := func(dir string, want bool) {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for watched(dir) != want {
+			select {
+			case ev := <-w.Events:
+				if ev.Name != ignoreFile {
+					t.Fatalf("Unexpected event %v", ev)
+				}
+			case err := <-w.Errors:
+				t.Fatalf("Error from watcher: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			case <-timeout:
+				t.Fatalf("Expected watched(%q) to be %v, got %q", dir, want, w.WatchList())
+			}
+		}
+	}
+
+	writeFile(filepath.Join(srcDir, "debug.log"), "")
+	writeFile(filepath.Join(testDir, "secret.txt"), "")
+	writeFile(filepath.Join(buildDir, "main"), "")
+	writeFile(filepath.Join(srcDir, "main.go"), "")
+	expect(filepath.Join(srcDir, "main.go"))
+
+	// No longer ignored.
+	writeFile(ignoreFile, "*.log\n")
+	waitWatched(buildDir, true)
+	writeFile(filepath.Join(buildDir, "main.o"), "")
+	expect(filepath.Join(buildDir, "main.o"))
+
+	// Ignored from now on.
+	writeFile(excludeFile, "src/\n")
+	waitWatched(srcDir, false)
+	writeFile(filepath.Join(srcDir, "util.go"), "")
+	writeFile(filepath.Join(testDir, "README"), "")
+	expect(filepath.Join(testDir, "README"))
+
+	if err := w.RemoveRecursive(testDir); err != nil {
+		t.Fatalf("Failed to remove testDir: %v", err)
+	}
+	w.mu.Lock()
+	n := len(w.watches)
+	w.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("Expected no watches left, got %d", n)
+	}
+}
+
+func TestInotifyGitignoreParent(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	srcDir := filepath.Join(testDir, "src")
+	for _, dir := range []string{filepath.Join(testDir, ".git"), srcDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.AddWith(srcDir, WithGitignore()); err != nil {
+		t.Fatalf("Failed to add srcDir: %v", err)
+	}
+	if list := w.WatchList(); len(list) != 1 || list[0] != srcDir {
+		t.Fatalf("Expected only %q to be watched, got %q", srcDir, list)
+	}
+
+	// The ignore file above the watched directory is read again once it
+	// changes, before anything that happens after.
+	if err := ioutil.WriteFile(filepath.Join(testDir, ".gitignore"), []byte("*.tmp\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	testFile := filepath.Join(srcDir, "main.go")
+	for _, name := range []string{filepath.Join(srcDir, "main.go.tmp"), testFile} {
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	expectEvent(t, w, Event{Name: testFile, Op: Create})
+
+	if err := w.Remove(srcDir); err != nil {
+		t.Fatalf("Failed to remove srcDir: %v", err)
+	}
+	w.mu.Lock()
+	n := len(w.watches)
+	w.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("Expected no watches left, got %d", n)
+	}
+}
+
+func TestInotifyBuffers(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	// Too small to read even one event, so raised to fit the longest name.
+	w, err := NewWatcherWithOptions(WithEventBuffer(16), WithReadBuffer(1))
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if cap(w.Events) != 16 {
+		t.Fatalf("Expected Events to hold 16 events, got %d", cap(w.Events))
+	}
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+	longName := strings.Repeat("x", 250)
+	for i := 0; i < 10; i++ {
+		f, err := os.Create(filepath.Join(testDir, longName+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		f.Close()
+	}
+
+	// The events were buffered without anyone receiving them.
+	deadline := time.Now().Add(time.Second)
+	for len(w.Events) < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(w.Events) != 10 {
+		t.Fatalf("Expected 10 buffered events, got %d", len(w.Events))
+	}
+	for i := 0; i < 10; i++ {
+		ev := <-w.Events
+		if name := filepath.Join(testDir, longName+strconv.Itoa(i)); ev.Name != name || ev.Op != Create {
+			t.Fatalf("Expected %q: CREATE, got %v", name, ev)
+		}
+	}
+}
+
+func TestInotifyBatches(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+
+	w, err := NewWatcherWithOptions(WithBatches())
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(testDir); err != nil {
+		t.Fatalf("Failed to add testDir: %v", err)
+	}
+
+	// While the first batch waits to be received, the rest pile up in the
+	// kernel and come out together.
+	for i := 0; i < 20; i++ {
+		if err := ioutil.WriteFile(filepath.Join(testDir, strconv.Itoa(i)), nil, 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var events []Event
+	batches := 0
+	for len(events) < 20 {
+		select {
+		case batch := <-w.Batches:
+			batches++
+			events = append(events, batch...)
+		case ev := <-w.Events:
+			t.Fatalf("Unexpected event on Events: %v", ev)
+		case err := <-w.Errors:
+			t.Fatalf("Error from watcher: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Took too long to wait for batches, got %d events", len(events))
+		}
+	}
+	if batches > 2 {
+		t.Fatalf("Expected the events in at most 2 batches, got %d", batches)
+	}
+	for i, ev := range events {
+		if name := filepath.Join(testDir, strconv.Itoa(i)); ev.Name != name || ev.Op != Create || ev.Seq != uint64(i+1) {
+			t.Fatalf("Expected %q: CREATE #%d, got %v #%d", name, i+1, ev, ev.Seq)
+		}
+	}
+}
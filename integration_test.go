@@ -8,12 +8,15 @@
 package fsnotify
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -1244,6 +1247,155 @@ func TestRemoveWithClose(t *testing.T) {
 	}
 }
 
+func TestRun(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "TestRun.testfile")
+
+	watcher := newWatcher(t)
+	addWatch(t, watcher, testDir)
+
+	// A handler's error stops Run.
+	errStop := errors.New("stop")
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.Run(context.Background(), HandlerFuncs{
+			Event: func(event Event) error {
+				if event.Name == testFile && event.Op&Create == Create {
+					return errStop
+				}
+				return nil
+			},
+		})
+	}()
+	time.Sleep(eventSeparator)
+	f, err := os.OpenFile(testFile, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		t.Fatalf("creating test file failed: %s", err)
+	}
+	f.Close()
+	select {
+	case err := <-done:
+		if err != errStop {
+			t.Fatalf("Run returned %v, want %v", err, errStop)
+		}
+	case <-time.After(waitForEvents):
+		t.Fatal("Run didn't return after the handler failed")
+	}
+
+	// So does the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := watcher.Run(ctx, HandlerFuncs{}); err != context.Canceled {
+		t.Fatalf("Run returned %v, want %v", err, context.Canceled)
+	}
+
+	// And closing the Watcher, which isn't an error.
+	go func() {
+		done <- watcher.Run(context.Background(), HandlerFuncs{})
+	}()
+	time.Sleep(eventSeparator)
+	watcher.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after Close, want nil", err)
+		}
+	case <-time.After(waitForEvents):
+		t.Fatal("Run didn't return after Close")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	batches := make(chan []Event, 1)
+	watcher := &Watcher{Batches: batches}
+	batches <- []Event{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	// stopAt returns a handler recording what it was called with that stops
+	// Run at name.
+	var handled []string
+	errStop := errors.New("stop")
+	stopAt := func(name string) Handler {
+		return HandlerFuncs{
+			Event: func(event Event) error {
+				handled = append(handled, event.Name)
+				if event.Name == name {
+					return errStop
+				}
+				return nil
+			},
+		}
+	}
+
+	// What the handler didn't get to is kept for the next Run...
+	if err := watcher.Run(context.Background(), stopAt("a")); err != errStop {
+		t.Fatalf("Run returned %v, want %v", err, errStop)
+	}
+	if err := watcher.Run(context.Background(), stopAt("b")); err != errStop {
+		t.Fatalf("Run returned %v, want %v", err, errStop)
+	}
+	if got := strings.Join(handled, " "); got != "a b" {
+		t.Fatalf("Expected a and b to be handled, got %q", got)
+	}
+
+	// ...or for TryNext.
+	if event, ok, err := watcher.TryNext(); !ok || err != nil || event.Name != "c" {
+		t.Fatalf("TryNext returned %v, %v, %v, want c", event, ok, err)
+	}
+}
+
+func TestNext(t *testing.T) {
+	testDir := tempMkdir(t)
+	defer os.RemoveAll(testDir)
+	testFile := filepath.Join(testDir, "TestNext.testfile")
+
+	watcher := newWatcher(t)
+	addWatch(t, watcher, testDir)
+
+	if event, ok, err := watcher.TryNext(); ok {
+		t.Fatalf("TryNext returned %v, %v before anything happened", event, err)
+	}
+
+	f, err := os.OpenFile(testFile, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		t.Fatalf("creating test file failed: %s", err)
+	}
+	f.Close()
+
+	// Nobody receives from Events, yet nothing is held up.
+	ctx, cancel := context.WithTimeout(context.Background(), waitForEvents)
+	defer cancel()
+	for {
+		event, err := watcher.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if event.Name == testFile && event.Op&Create == Create {
+			break
+		}
+	}
+	time.Sleep(eventSeparator)
+	for {
+		_, ok, err := watcher.TryNext()
+		if !ok {
+			break
+		}
+		if err != nil {
+			t.Fatalf("TryNext failed: %s", err)
+		}
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := watcher.Next(cancelled); err != context.Canceled {
+		t.Fatalf("Next returned %v, want %v", err, context.Canceled)
+	}
+
+	watcher.Close()
+	if _, err := watcher.Next(ctx); err != ErrClosed {
+		t.Fatalf("Next returned %v after Close, want %v", err, ErrClosed)
+	}
+}
+
 func testRename(file1, file2 string) error {
 	switch runtime.GOOS {
 	case "windows", "plan9":
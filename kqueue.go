@@ -15,25 +15,33 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct {
-	Events chan Event
-	Errors chan error
-	done   chan struct{} // Channel for sending a "quit message" to the reader goroutine
+	Events  chan Event
+	Batches chan []Event // Events from each read, with WithBatches
+	Errors  chan error
+	done    chan struct{} // Channel for sending a "quit message" to the reader goroutine
 
 	kq int // File descriptor (as returned by the kqueue() syscall).
 
 	mu              sync.Mutex        // Protects access to watcher data
 	watches         map[string]int    // Map of watched file descriptors (key: path).
 	externalWatches map[string]bool   // Map of watches added by user of the library.
+	ops             map[string]Op     // Map of watches added by user of the library to the operations they asked for.
 	dirFlags        map[string]uint32 // Map of watched directories to fflags used in kqueue.
 	paths           map[int]pathInfo  // Map file descriptors to path names for processing kqueue events.
 	fileExists      map[string]bool   // Keep track of if we know this file exists (to stop duplicate create events).
 	isClosed        bool              // Set to true when Close() is first called
+	seq             uint64            // Sequence number of the last event sent (only used by readEvents)
+	readBuffer      int               // Number of kevents read at once, from WithReadBuffer
+	queue           queue             // Events and errors for Next and TryNext
+	batching        bool              // Set by WithBatches
+	batch           []Event           // Events read but not yet sent on Batches (only used by readEvents)
 }
 
 type pathInfo struct {
@@ -43,6 +51,13 @@ type pathInfo struct {
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (*Watcher, error) {
+	return NewWatcherWithOptions()
+}
+
+// NewWatcherWithOptions is like NewWatcher, but allows the Watcher to be
+// configured with options.
+func NewWatcherWithOptions(opts ...WatcherOption) (*Watcher, error) {
+	with := getWatcherOptions(opts...)
 	kq, err := kqueue()
 	if err != nil {
 		return nil, err
@@ -55,9 +70,13 @@ func NewWatcher() (*Watcher, error) {
 		paths:           make(map[int]pathInfo),
 		fileExists:      make(map[string]bool),
 		externalWatches: make(map[string]bool),
-		Events:          make(chan Event),
+		ops:             make(map[string]Op),
+		Events:          make(chan Event, with.eventBuffer(0)),
+		Batches:         make(chan []Event, with.eventBuffer(0)),
+		batching:        with.batches,
 		Errors:          make(chan error),
 		done:            make(chan struct{}),
+		readBuffer:      with.readBufferSize(10*keventSize, keventSize) / keventSize,
 	}
 
 	go w.readEvents()
@@ -93,11 +112,53 @@ func (w *Watcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *Watcher) Add(name string) error {
+	return w.AddWith(name)
+}
+
+// AddWith is like Add, but allows the watch to be configured with options.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	with := getOptions(opts...)
+	name = filepath.Clean(name)
+	if with.ops&^portableOps != 0 {
+		return &WatchError{Op: "add", Path: name, Err: fmt.Errorf("%w: %s", ErrUnsupportedOp, with.ops&^portableOps)}
+	}
+	if !with.exclude.empty() || with.pending {
+		return &WatchError{Op: "add", Path: name, Err: ErrNotSupported}
+	}
+
 	w.mu.Lock()
 	w.externalWatches[name] = true
+	w.ops[name] |= with.ops
 	w.mu.Unlock()
-	_, err := w.addWatch(name, noteAllEvents)
-	return err
+
+	// Directories need NOTE_WRITE to notice their entries changing.
+	flags := opsToNotes(w.opsFor(name))
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		flags |= unix.NOTE_WRITE
+	}
+	if _, err := w.addWatch(name, flags); err != nil {
+		return &WatchError{Op: "add", Path: name, Err: err}
+	}
+	return nil
+}
+
+// AddRecursive is like AddWith, but also watches the directories below name.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) AddRecursive(name string, opts ...AddOption) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(name), Err: ErrNotSupported}
+}
+
+// WatchFile starts watching the file name by its path, following it across
+// replacements.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) WatchFile(name string) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(name), Err: ErrNotSupported}
+}
+
+// AddGlob starts watching the files and directories matching pattern.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) AddGlob(pattern string, opts ...AddOption) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(pattern), Err: ErrNotSupported}
 }
 
 // Remove stops watching the the named file or directory (non-recursively).
@@ -107,12 +168,12 @@ func (w *Watcher) Remove(name string) error {
 	watchfd, ok := w.watches[name]
 	w.mu.Unlock()
 	if !ok {
-		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+		return &WatchError{Op: "remove", Path: name, Err: ErrNonExistentWatch}
 	}
 
 	const registerRemove = unix.EV_DELETE
 	if err := register(w.kq, []int{watchfd}, registerRemove, 0); err != nil {
-		return err
+		return &WatchError{Op: "remove", Path: name, Err: err}
 	}
 
 	unix.Close(watchfd)
@@ -122,6 +183,7 @@ func (w *Watcher) Remove(name string) error {
 	delete(w.watches, name)
 	delete(w.paths, watchfd)
 	delete(w.dirFlags, name)
+	delete(w.ops, name)
 	w.mu.Unlock()
 
 	// Find all watched paths that are in this directory that are not external.
@@ -148,6 +210,27 @@ func (w *Watcher) Remove(name string) error {
 	return nil
 }
 
+// RemoveRecursive stops watching name and every file and directory below it,
+// however they were added.
+func (w *Watcher) RemoveRecursive(name string) error {
+	name = filepath.Clean(name)
+	var found bool
+	for _, path := range w.WatchList() {
+		if !inTree(name, path) {
+			continue
+		}
+		found = true
+		// Watches on the contents of a directory can go along with it.
+		if err := w.Remove(path); err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			return err
+		}
+	}
+	if !found {
+		return &WatchError{Op: "remove", Path: name, Err: ErrNonExistentWatch}
+	}
+	return nil
+}
+
 // WatchList returns the directories and files that are being monitered.
 func (w *Watcher) WatchList() []string {
 	w.mu.Lock()
@@ -161,12 +244,39 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
-// Watch all events (except NOTE_EXTEND, NOTE_LINK, NOTE_REVOKE)
-const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME
+// opsToNotes returns the kqueue fflags needed to report ops on a file.
+// NOTE_DELETE and NOTE_RENAME are always needed to keep track of watches.
+func opsToNotes(ops Op) uint32 {
+	var flags uint32 = unix.NOTE_DELETE | unix.NOTE_RENAME
+	if ops&Write == Write {
+		flags |= unix.NOTE_WRITE
+	}
+	if ops&Chmod == Chmod {
+		flags |= unix.NOTE_ATTRIB
+	}
+	return flags
+}
+
+// opsFor returns the operations to report for name: the union of what was
+// asked for by a watch on name itself and on the directory containing it,
+// or every portable operation if neither is known.
+func (w *Watcher) opsFor(name string) Op {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ops, found := w.ops[name]
+	dirOps, dirFound := w.ops[filepath.Dir(name)]
+	if !found && !dirFound {
+		return portableOps
+	}
+	return ops | dirOps
+}
 
 // keventWaitTime to block on each read from kevent
 var keventWaitTime = durationToTimespec(100 * time.Millisecond)
 
+// keventSize is the size of a kevent, which WithReadBuffer counts in.
+const keventSize = int(unsafe.Sizeof(unix.Kevent_t{}))
+
 // addWatch adds name to the watched file set.
 // The flags are interpreted as described in kevent(2).
 // Returns the real path to the file which was added, if any, which may be different from the one passed in the case of symlinks.
@@ -178,7 +288,7 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
-		return "", errors.New("kevent instance already closed")
+		return "", ErrClosed
 	}
 	watchfd, alreadyWatching := w.watches[name]
 	// We already have a watch, but we can still override flags.
@@ -273,7 +383,7 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 // readEvents reads from kqueue and converts the received kevents into
 // Event values that it sends down the Events channel.
 func (w *Watcher) readEvents() {
-	eventBuffer := make([]unix.Kevent_t, 10)
+	eventBuffer := make([]unix.Kevent_t, w.readBuffer)
 
 loop:
 	for {
@@ -284,18 +394,25 @@ loop:
 		default:
 		}
 
+		// Send what the last read brought before waiting for more.
+		if !w.sendBatch() {
+			break loop
+		}
+
 		// Get new events
 		kevents, err := read(w.kq, eventBuffer, &keventWaitTime)
 		// EINTR is okay, the syscall was interrupted before timeout expired.
 		if err != nil && err != unix.EINTR {
 			select {
-			case w.Errors <- err:
+			case w.Errors <- &WatchError{Op: "read", Err: err}:
 			case <-w.done:
 				break loop
 			}
 			continue
 		}
 
+		now := time.Now()
+
 		// Flush the events we received to the Events channel
 		for len(kevents) > 0 {
 			kevent := &kevents[0]
@@ -305,6 +422,12 @@ loop:
 			path := w.paths[watchfd]
 			w.mu.Unlock()
 			event := newEvent(path.name, mask)
+			event.IsDir = path.isDir
+			ops := w.opsFor(path.name)
+			event.Time = now
+			// The buffer is reused by the next read, so hand out a copy.
+			sys := *kevent
+			event.sys = &sys
 
 			if path.isDir && !(event.Op&Remove == Remove) {
 				// Double check to make sure the directory exists. This can happen when
@@ -327,10 +450,11 @@ loop:
 			if path.isDir && event.Op&Write == Write && !(event.Op&Remove == Remove) {
 				w.sendDirectoryChangeEvents(event.Name)
 			} else {
-				// Send the event on the Events channel.
-				select {
-				case w.Events <- event:
-				case <-w.done:
+				// Send the event on the Events channel, if it was asked for;
+				// what happened still decides what to look at next.
+				sent := event
+				sent.Op &= ops
+				if sent.Op != 0 && !w.sendEvent(sent) {
 					break loop
 				}
 			}
@@ -375,6 +499,7 @@ loop:
 		}
 	}
 	close(w.Events)
+	close(w.Batches)
 	close(w.Errors)
 }
 
@@ -396,8 +521,47 @@ func newEvent(name string, mask uint32) Event {
 	return e
 }
 
-func newCreateEvent(name string) Event {
-	return Event{Name: name, Op: Create}
+// sendEvent sends e on the Events channel, or holds it back for the next
+// batch with WithBatches, numbering it with the next sequence number. It
+// returns false if the Watcher was closed before the event could be
+// delivered.
+func (w *Watcher) sendEvent(e Event) bool {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	w.seq++
+	e.Seq = w.seq
+	if w.batching {
+		w.batch = append(w.batch, e)
+		return true
+	}
+	select {
+	case w.Events <- e:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendBatch sends the events held back by sendEvent with WithBatches on the
+// Batches channel. It returns false if the Watcher was closed before the
+// batch could be delivered.
+func (w *Watcher) sendBatch() bool {
+	if len(w.batch) == 0 {
+		return true
+	}
+	batch := w.batch
+	w.batch = nil
+	select {
+	case w.Batches <- batch:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func newCreateEvent(name string, isDir bool) Event {
+	return Event{Name: name, Op: Create, IsDir: isDir}
 }
 
 // watchDirectoryFiles to mimic inotify when adding a watch on a directory
@@ -453,11 +617,9 @@ func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fileInfo os.FileInf
 	w.mu.Lock()
 	_, doesExist := w.fileExists[filePath]
 	w.mu.Unlock()
-	if !doesExist {
+	if !doesExist && w.opsFor(filePath)&Create == Create {
 		// Send create event
-		select {
-		case w.Events <- newCreateEvent(filePath):
-		case <-w.done:
+		if !w.sendEvent(newCreateEvent(filePath, fileInfo.IsDir())) {
 			return
 		}
 	}
@@ -488,7 +650,7 @@ func (w *Watcher) internalWatch(name string, fileInfo os.FileInfo) (string, erro
 	}
 
 	// watch file to mimic Linux inotify
-	return w.addWatch(name, noteAllEvents)
+	return w.addWatch(name, opsToNotes(w.opsFor(name)))
 }
 
 // kqueue creates a new kernel event queue and returns a descriptor.
@@ -0,0 +1,157 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package fsnotify
+
+import (
+	"context"
+	"sync"
+)
+
+// Next returns the next event, or the next error that would be sent on
+// Errors, waiting for one until ctx is done. Once the Watcher is closed and
+// everything before has been returned, it returns ErrClosed.
+//
+// Next and TryNext let an event loop pull events when it is ready for them,
+// without a goroutine of its own or a select on Events and Errors. The first
+// call starts taking in everything the Watcher sends into a queue, which
+// grows as needed, so the Watcher never waits for the caller; Events and
+// Errors must not be received from after that.
+func (w *Watcher) Next(ctx context.Context) (Event, error) {
+	q := w.startQueue()
+	for {
+		if event, ok, err := q.pop(); ok {
+			return event, err
+		}
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-q.ready:
+		}
+	}
+}
+
+// TryNext is like Next, but doesn't wait: it reports false if nothing is
+// queued.
+func (w *Watcher) TryNext() (Event, bool, error) {
+	return w.startQueue().pop()
+}
+
+// startQueue starts filling the queue of w, the first time it is called.
+func (w *Watcher) startQueue() *queue {
+	q := &w.queue
+	q.once.Do(func() {
+		q.ready = make(chan struct{}, 1)
+		go q.fill(w.Events, w.Batches, w.Errors)
+	})
+	return q
+}
+
+// queue holds the events and errors of a Watcher for Next and TryNext.
+type queue struct {
+	once   sync.Once
+	ready  chan struct{} // Signalled when an item is added or the queue closed
+	mu     sync.Mutex
+	items  []queued
+	closed bool // The Watcher was closed; nothing more will be added
+}
+
+// queued is an event or an error in a queue.
+type queued struct {
+	event Event
+	err   error
+}
+
+// fill adds what is received from events, batches and errors to q, until
+// they are all closed.
+func (q *queue) fill(events <-chan Event, batches <-chan []Event, errors <-chan error) {
+	for events != nil || batches != nil || errors != nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			q.push(queued{event: event})
+		case batch, ok := <-batches:
+			if !ok {
+				batches = nil
+				continue
+			}
+			for _, event := range batch {
+				q.push(queued{event: event})
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			q.push(queued{err: err})
+		}
+	}
+
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// unshift puts events back at the front of q, for Run to leave the rest of
+// a batch to whatever takes events next.
+func (q *queue) unshift(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	items := make([]queued, 0, len(events))
+	for _, event := range events {
+		items = append(items, queued{event: event})
+	}
+	q.mu.Lock()
+	q.items = append(items, q.items...)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *queue) push(item queued) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// signal wakes up a Next waiting for q, if there is one.
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the first item off q. It returns ErrClosed once q is closed and
+// empty, and false if q is merely empty.
+func (q *queue) pop() (Event, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		if q.closed {
+			// Other calls to Next may be waiting too.
+			q.signal()
+			return Event{}, true, ErrClosed
+		}
+		return Event{}, false, nil
+	}
+	item := q.items[0]
+	q.items[0] = queued{}
+	q.items = q.items[1:]
+	if len(q.items) == 0 {
+		// Let go of the array, which a burst may have made large.
+		q.items = nil
+	} else {
+		q.signal()
+	}
+	return item.event, true, item.err
+}
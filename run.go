@@ -0,0 +1,114 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package fsnotify
+
+import "context"
+
+// Handler handles what a Watcher reports, for Watcher.Run.
+type Handler interface {
+	// HandleEvent is called for every event. Returning an error stops Run.
+	HandleEvent(Event) error
+	// HandleError is called for every error. Returning an error, such as
+	// the one it was given, stops Run.
+	HandleError(error) error
+}
+
+// HandlerFuncs is a Handler calling the functions in it. A nil function
+// ignores what it would be called with.
+type HandlerFuncs struct {
+	Event func(Event) error
+	Error func(error) error
+}
+
+// HandleEvent calls h.Event, if set.
+func (h HandlerFuncs) HandleEvent(event Event) error {
+	if h.Event == nil {
+		return nil
+	}
+	return h.Event(event)
+}
+
+// HandleError calls h.Error, if set.
+func (h HandlerFuncs) HandleError(err error) error {
+	if h.Error == nil {
+		return nil
+	}
+	return h.Error(err)
+}
+
+// Run receives the events and errors of the Watcher and passes them to h,
+// one at a time, so that the loop receiving from Events and Errors doesn't
+// have to be written out. It returns when ctx is done, with ctx.Err(); when
+// the Watcher is closed, with nil; or when h returns an error, with that
+// error. The Watcher is still open after Run returns for any other reason
+// than Close, so it should be closed or run again. If h returns an error in
+// the middle of a batch, the rest of it is kept for the next call to Run,
+// Next or TryNext:
+//
+//	defer w.Close()
+//	err := w.Run(ctx, fsnotify.HandlerFuncs{
+//		Event: func(e fsnotify.Event) error {
+//			log.Println(e)
+//			return nil
+//		},
+//		Error: func(err error) error {
+//			return err
+//		},
+//	})
+func (w *Watcher) Run(ctx context.Context, h Handler) error {
+	// Start with what an earlier Run left of a batch.
+	for {
+		event, ok, err := w.queue.pop()
+		if !ok {
+			break
+		}
+		if err == ErrClosed {
+			return nil
+		}
+		if err != nil {
+			if err := h.HandleError(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := h.HandleEvent(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if err := h.HandleEvent(event); err != nil {
+				return err
+			}
+		case batch, ok := <-w.Batches:
+			if !ok {
+				return nil
+			}
+			for i, event := range batch {
+				if err := h.HandleEvent(event); err != nil {
+					w.queue.unshift(batch[i+1:])
+					return err
+				}
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			if err := h.HandleError(err); err != nil {
+				return err
+			}
+		}
+	}
+}
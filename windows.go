@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -23,31 +24,47 @@ import (
 
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct {
-	Events chan Event
-	Errors chan error
+	Events  chan Event
+	Batches chan []Event // Events from each completed read, with WithBatches
+	Errors  chan error
 
 	port  syscall.Handle // Handle to completion port
 	input chan *input    // Inputs to the reader are sent on this channel
 	quit  chan chan<- error
 
-	mu       sync.Mutex // Protects access to watches, isClosed
-	watches  watchMap   // Map of watches (key: i-number)
-	isClosed bool       // Set to true when Close() is first called
+	mu         sync.Mutex // Protects access to watches, isClosed
+	watches    watchMap   // Map of watches (key: i-number)
+	isClosed   bool       // Set to true when Close() is first called
+	seq        uint64     // Sequence number of the last event sent (only used by the I/O thread)
+	readBuffer int        // Size of the buffer of each watch, from WithReadBuffer
+	queue      queue      // Events and errors for Next and TryNext
+	batching   bool       // Set by WithBatches
+	batch      []Event    // Events read but not yet sent on Batches (only used by the I/O thread)
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
 func NewWatcher() (*Watcher, error) {
+	return NewWatcherWithOptions()
+}
+
+// NewWatcherWithOptions is like NewWatcher, but allows the Watcher to be
+// configured with options.
+func NewWatcherWithOptions(opts ...WatcherOption) (*Watcher, error) {
+	with := getWatcherOptions(opts...)
 	port, e := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
 	if e != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", e)
 	}
 	w := &Watcher{
-		port:    syscall.Handle(port),
-		watches: make(watchMap),
-		input:   make(chan *input, 1),
-		Events:  make(chan Event, 50),
-		Errors:  make(chan error),
-		quit:    make(chan chan<- error, 1),
+		port:       syscall.Handle(port),
+		watches:    make(watchMap),
+		input:      make(chan *input, 1),
+		Events:     make(chan Event, with.eventBuffer(50)),
+		Batches:    make(chan []Event, with.eventBuffer(50)),
+		batching:   with.batches,
+		Errors:     make(chan error),
+		quit:       make(chan chan<- error, 1),
+		readBuffer: with.readBufferSize(4096, int(unsafe.Sizeof(syscall.FileNotifyInformation{}))+syscall.MAX_PATH*2),
 	}
 	go w.readEvents()
 	return w, nil
@@ -75,37 +92,99 @@ func (w *Watcher) Close() error {
 
 // Add starts watching the named file or directory (non-recursively).
 func (w *Watcher) Add(name string) error {
+	return w.AddWith(name)
+}
+
+// AddWith is like Add, but allows the watch to be configured with options.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	name = filepath.Clean(name)
+	with := getOptions(opts...)
+	if with.ops&^portableOps != 0 {
+		return &WatchError{Op: "add", Path: name, Err: fmt.Errorf("%w: %s", ErrUnsupportedOp, with.ops&^portableOps)}
+	}
+	if !with.exclude.empty() || with.pending {
+		return &WatchError{Op: "add", Path: name, Err: ErrNotSupported}
+	}
+
 	w.mu.Lock()
 	if w.isClosed {
-		return errors.New("watcher already closed")
+		w.mu.Unlock()
+		return &WatchError{Op: "add", Path: name, Err: ErrClosed}
 	}
 	w.mu.Unlock()
 
 	in := &input{
 		op:    opAddWatch,
-		path:  filepath.Clean(name),
-		flags: sysFSALLEVENTS,
+		path:  name,
+		flags: opsToFlags(with.ops),
 		reply: make(chan error),
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
-		return err
+		return &WatchError{Op: "add", Path: name, Err: err}
+	}
+	if err := <-in.reply; err != nil {
+		return &WatchError{Op: "add", Path: name, Err: err}
 	}
-	return <-in.reply
+	return nil
+}
+
+// AddRecursive is like AddWith, but also watches the directories below name.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) AddRecursive(name string, opts ...AddOption) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(name), Err: ErrNotSupported}
+}
+
+// WatchFile starts watching the file name by its path, following it across
+// replacements.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) WatchFile(name string) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(name), Err: ErrNotSupported}
+}
+
+// AddGlob starts watching the files and directories matching pattern.
+// It is only implemented on Linux, and returns ErrNotSupported here.
+func (w *Watcher) AddGlob(pattern string, opts ...AddOption) error {
+	return &WatchError{Op: "add", Path: filepath.Clean(pattern), Err: ErrNotSupported}
 }
 
 // Remove stops watching the the named file or directory (non-recursively).
 func (w *Watcher) Remove(name string) error {
+	name = filepath.Clean(name)
 	in := &input{
 		op:    opRemoveWatch,
-		path:  filepath.Clean(name),
+		path:  name,
 		reply: make(chan error),
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
-		return err
+		return &WatchError{Op: "remove", Path: name, Err: err}
+	}
+	if err := <-in.reply; err != nil {
+		return &WatchError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// RemoveRecursive stops watching name and every file and directory below it,
+// however they were added.
+func (w *Watcher) RemoveRecursive(name string) error {
+	name = filepath.Clean(name)
+	var found bool
+	for _, path := range w.WatchList() {
+		if !inTree(name, path) {
+			continue
+		}
+		found = true
+		// Watches on the contents of a directory can go along with it.
+		if err := w.Remove(path); err != nil && !errors.Is(err, ErrNonExistentWatch) {
+			return err
+		}
 	}
-	return <-in.reply
+	if !found {
+		return &WatchError{Op: "remove", Path: name, Err: ErrNonExistentWatch}
+	}
+	return nil
 }
 
 // WatchList returns the directories and files that are being monitered.
@@ -147,6 +226,30 @@ const (
 	sysFSQOVERFLOW = 0x4000
 )
 
+// opsToFlags returns the notify flags needed to report ops. Adding the same
+// path again with other ops widens the flags the watch is read with.
+func opsToFlags(ops Op) uint32 {
+	var flags uint32
+	if ops&Create == Create {
+		flags |= sysFSCREATE | sysFSMOVEDTO
+	}
+	if ops&Write == Write {
+		// Windows reports last-access changes as modifications too, and
+		// watches have always included them.
+		flags |= sysFSMODIFY | sysFSACCESS
+	}
+	if ops&Remove == Remove {
+		flags |= sysFSDELETE | sysFSDELETESELF
+	}
+	if ops&Rename == Rename {
+		flags |= sysFSMOVE | sysFSMOVESELF
+	}
+	if ops&Chmod == Chmod {
+		flags |= sysFSATTRIB
+	}
+	return flags
+}
+
 func newEvent(name string, mask uint32) Event {
 	e := Event{Name: name}
 	if mask&sysFSCREATE == sysFSCREATE || mask&sysFSMOVEDTO == sysFSMOVEDTO {
@@ -164,6 +267,9 @@ func newEvent(name string, mask uint32) Event {
 	if mask&sysFSATTRIB == sysFSATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&sysFSQOVERFLOW == sysFSQOVERFLOW {
+		e.Op |= Overflow
+	}
 	return e
 }
 
@@ -196,7 +302,7 @@ type watch struct {
 	mask   uint64            // Directory itself is being watched with these notify flags
 	names  map[string]uint64 // Map of names being watched and their notify flags
 	rename string            // Remembers the old name while renaming a file
-	buf    [4096]byte
+	buf    []byte            // Buffer ReadDirectoryChanges fills
 }
 
 type (
@@ -299,6 +405,7 @@ func (w *Watcher) addWatch(pathname string, flags uint64) error {
 			ino:   ino,
 			path:  dir,
 			names: make(map[string]uint64),
+			buf:   make([]byte, w.readBuffer),
 		}
 		w.mu.Lock()
 		w.watches.set(ino, watchEntry)
@@ -337,7 +444,7 @@ func (w *Watcher) remWatch(pathname string) error {
 	watch := w.watches.get(ino)
 	w.mu.Unlock()
 	if watch == nil {
-		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+		return ErrNonExistentWatch
 	}
 	if pathname == dir {
 		w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
@@ -386,7 +493,7 @@ func (w *Watcher) startRead(watch *watch) error {
 		return nil
 	}
 	e := syscall.ReadDirectoryChanges(watch.ino.handle, &watch.buf[0],
-		uint32(unsafe.Sizeof(watch.buf)), false, mask, nil, &watch.ov, 0)
+		uint32(len(watch.buf)), false, mask, nil, &watch.ov, 0)
 	if e != nil {
 		err := os.NewSyscallError("ReadDirectoryChanges", e)
 		if e == syscall.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
@@ -416,6 +523,9 @@ func (w *Watcher) readEvents() {
 	runtime.LockOSThread()
 
 	for {
+		// Send what the last read brought before waiting for more.
+		w.sendBatch()
+
 		uKey := uintptr(key)
 		e := windows.GetQueuedCompletionStatus(windows.Handle(w.port), &n, &uKey, &ov, syscall.INFINITE)
 		watch := (*watch)(unsafe.Pointer(ov))
@@ -440,6 +550,7 @@ func (w *Watcher) readEvents() {
 					err = os.NewSyscallError("CloseHandle", e)
 				}
 				close(w.Events)
+				close(w.Batches)
 				close(w.Errors)
 				ch <- err
 				return
@@ -463,7 +574,7 @@ func (w *Watcher) readEvents() {
 				// The i/o succeeded but the buffer is full.
 				// In theory we should be building up a full packet.
 				// In practice we can get away with just carrying on.
-				n = uint32(unsafe.Sizeof(watch.buf))
+				n = uint32(len(watch.buf))
 			}
 		case syscall.ERROR_ACCESS_DENIED:
 			// Watched directory was probably removed
@@ -483,7 +594,7 @@ func (w *Watcher) readEvents() {
 		var offset uint32
 		for {
 			if n == 0 {
-				w.Events <- newEvent("", sysFSQOVERFLOW)
+				w.deliver(w.stamp(newEvent("", sysFSQOVERFLOW)))
 				w.Errors <- errors.New("short read in readEvents()")
 				break
 			}
@@ -566,12 +677,55 @@ func (w *Watcher) sendEvent(name string, mask uint64) bool {
 		return false
 	}
 	event := newEvent(name, uint32(mask))
+	// ReadDirectoryChangesW doesn't say what kind of file changed, so look
+	// while it still exists.
+	if event.Op&(Remove|Rename) == 0 {
+		if fi, err := os.Lstat(name); err == nil {
+			event.IsDir = fi.IsDir()
+		}
+	}
+	w.deliver(w.stamp(event))
+	return true
+}
+
+// deliver sends e on the Events channel, or holds it back for the next batch
+// with WithBatches. It gives up if the Watcher is being closed.
+// Must run within the I/O thread.
+func (w *Watcher) deliver(e Event) {
+	if w.batching {
+		w.batch = append(w.batch, e)
+		return
+	}
 	select {
 	case ch := <-w.quit:
 		w.quit <- ch
-	case w.Events <- event:
+	case w.Events <- e:
 	}
-	return true
+}
+
+// sendBatch sends the events held back by deliver with WithBatches on the
+// Batches channel, unless the Watcher is being closed.
+// Must run within the I/O thread.
+func (w *Watcher) sendBatch() {
+	if len(w.batch) == 0 {
+		return
+	}
+	batch := w.batch
+	w.batch = nil
+	select {
+	case ch := <-w.quit:
+		w.quit <- ch
+	case w.Batches <- batch:
+	}
+}
+
+// stamp sets the receive time and the next sequence number on e.
+// Must run within the I/O thread.
+func (w *Watcher) stamp(e Event) Event {
+	w.seq++
+	e.Seq = w.seq
+	e.Time = time.Now()
+	return e
 }
 
 func toWindowsFlags(mask uint64) uint32 {